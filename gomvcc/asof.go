@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errSnapshotTooOld = errors.New("snapshot too old")
+
+// Starts a read-only transaction that sees what was committed right
+// after the transaction txId committed, and nothing since.
+func (d *Database) newTransactionAsOf(isolation IsolationLevel, txId uint64) (*Transaction, error) {
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+
+	// No transaction has id 0.
+	past, ok := d.transactions.Get(txId)
+	if !ok && txId > 0 && txId < d.vacuumHorizon {
+		return nil, errSnapshotTooOld
+	}
+	if !ok || past.state != CommittedTransaction {
+		return nil, badArgs("transaction %d did not commit", txId)
+	}
+	// Vacuum may have removed versions deleted, or that expired,
+	// and the records of transactions that committed, after it, or
+	// be removing them.
+	if past.commitSeq < d.vacuumedCommitSeq || past.committedAt.Before(d.vacuumedExpiresAt) || past.committedAt.Before(d.vacuumingExpiredBefore) {
+		return nil, errSnapshotTooOld
+	}
+
+	// A prepared transaction earlier in the commit order would
+	// become visible when it commits.
+	for _, other := range d.prepared {
+		if other.commitSeq <= past.commitSeq {
+			return nil, fmt.Errorf("transaction %d is prepared", other.id)
+		}
+	}
+
+	t := d.newTransactionLocked(isolation, true)
+	t.asof = past.commitSeq
+	t.asofTime = past.committedAt
+	t.asofHorizon = t.id
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok && iter.Key() < t.asofHorizon; ok = iter.Next() {
+		other := iter.Value()
+		if other.state == InProgressTransaction || other.state == CommittedTransaction && other.commitSeq > t.asof {
+			t.asofHorizon = other.id
+		}
+	}
+	return t, nil
+}
+
+// Whether the transaction had committed when the one with commitSeq
+// asof did.
+func (d *Database) committedAsOf(txId uint64, asof uint64) bool {
+	d.txMu.RLock()
+	defer d.txMu.RUnlock()
+
+	t, ok := d.transactions.Get(txId)
+	if !ok {
+		// Transactions that reading as of a commit depends on
+		// aren't vacuumed before it, so this one committed in
+		// time.
+		return txId < d.vacuumHorizon
+	}
+	return t.state == CommittedTransaction && t.commitSeq <= asof
+}
+
+// The oldest transaction id that reading as of one of the last
+// retainCommits committed transactions may need to tell apart from the
+// ones before it. The caller must hold txMu.
+func (d *Database) retentionHorizon() uint64 {
+	horizon := d.nextTransactionId
+	if d.retainCommits == 0 {
+		return horizon
+	}
+	if d.nextCommitSeq <= d.retainCommits {
+		return 0
+	}
+
+	oldest := d.nextCommitSeq - d.retainCommits
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if t.state != AbortedTransaction && (t.state == InProgressTransaction || t.commitSeq >= oldest) {
+			return t.id
+		}
+	}
+	return horizon
+}
+
+// When the oldest of the last retainCommits committed transactions
+// committed. Reading as of one of them may need versions that expired
+// since. The caller must hold txMu.
+func (d *Database) retentionTime() time.Time {
+	oldest := d.now()
+	if d.retainCommits == 0 {
+		return oldest
+	}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if t.state == CommittedTransaction && t.commitSeq+d.retainCommits >= d.nextCommitSeq && t.committedAt.Before(oldest) {
+			oldest = t.committedAt
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("set", []string{"y", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", []string{"readonly"})
+	_, err := c1.execCommand("set", []string{"x", "2"})
+	assertEq(err.Error(), "transaction is read-only", "c1 set x")
+	_, err = c1.execCommand("delete", []string{"x"})
+	assertEq(err.Error(), "transaction is read-only", "c1 delete x")
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("get", []string{"x"})
+	c2.mustExecCommand("get", []string{"y"})
+
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+	assertEq(c1.tx.readset.Len(), 0, "c1 readset")
+
+	// Overwriting what c1 read doesn't conflict with it, and c1
+	// doesn't abort.
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("commit", nil)
+	res = c1.mustExecCommand("get", []string{"y"})
+	assertEq(res, "1", "c1 get y")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestReadOnly_twoPhaseLocking(t *testing.T) {
+	database := newLockingDatabase()
+	database.defaultIsolation = SnapshotIsolation
+	database.lockNoWait = true
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", []string{"readonly"})
+	c1.mustExecCommand("scan", []string{"a"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+
+	// Read-only transactions take no locks, and read from their
+	// snapshot.
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+	c2.mustExecCommand("commit", nil)
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x again")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestAsOf(t *testing.T) {
+	database := newDatabase()
+
+	c := database.newConnection()
+	for _, command := range [][]string{
+		{"set", "x", "1"},
+		{"set", "x", "2"},
+		{"delete", "x"},
+	} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand(command[0], command[1:])
+		c.mustExecCommand("commit", nil)
+	}
+
+	// 4 commits after 5 did.
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	c4.mustExecCommand("set", []string{"y", "4"})
+	c5 := database.newConnection()
+	c5.mustExecCommand("begin", nil)
+	c5.mustExecCommand("set", []string{"z", "5"})
+	c5.mustExecCommand("commit", nil)
+	c4.mustExecCommand("commit", nil)
+
+	for _, test := range []struct {
+		asof  string
+		found map[string]string
+	}{
+		{"1", map[string]string{"x": "1"}},
+		{"2", map[string]string{"x": "2"}},
+		{"3", map[string]string{}},
+		{"5", map[string]string{"z": "5"}},
+		{"4", map[string]string{"y": "4", "z": "5"}},
+	} {
+		c.mustExecCommand("begin", []string{"snapshot", "asof", test.asof})
+		for _, key := range []string{"x", "y", "z"} {
+			res, err := c.execCommand("get", []string{key})
+			if value, ok := test.found[key]; ok {
+				assertEq(err, nil, "asof "+test.asof+" get "+key)
+				assertEq(res, value, "asof "+test.asof+" get "+key)
+			} else {
+				assertEq(err.Error(), "key not found", "asof "+test.asof+" get "+key)
+			}
+		}
+		_, err := c.execCommand("set", []string{"x", "3"})
+		assertEq(err.Error(), "transaction is read-only", "asof "+test.asof+" set x")
+		c.mustExecCommand("commit", nil)
+	}
+}
+
+func TestAsOf_uncommitted(t *testing.T) {
+	database := newDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("abort", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c := database.newConnection()
+	for _, txId := range []string{"0", "1", "2", "10"} {
+		_, err := c.execCommand("begin", []string{"asof", txId})
+		assert(errors.Is(err, ErrBadArgs), "asof "+txId)
+		assertEq(err.Error(), "transaction "+txId+" did not commit", "asof "+txId)
+		assertEq(c.tx, nil, "no transaction after asof "+txId)
+	}
+	_, err := c.execCommand("begin", []string{"asof"})
+	assertEq(err.Error(), "usage: begin [level] [readonly] [asof <txid>]", "asof")
+}
+
+func TestAsOf_vacuum(t *testing.T) {
+	database := newDatabase()
+
+	c := database.newConnection()
+	for _, value := range []string{"1", "2"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", []string{"asof", "1"})
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "3"})
+	c.mustExecCommand("commit", nil)
+
+	// Reading as of a transaction keeps what it needs from being
+	// vacuumed.
+	c.mustExecCommand("vacuum", nil)
+	assertEq(versionCount(&database, "x"), 3, "versions of x")
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+	c1.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("vacuum", nil)
+	assertEq(versionCount(&database, "x"), 1, "versions of x")
+	_, err := c1.execCommand("begin", []string{"asof", "1"})
+	assertEq(err, errSnapshotTooOld, "asof 1")
+	_, err = c1.execCommand("begin", []string{"asof", "3"})
+	assertEq(err, errSnapshotTooOld, "asof 3")
+}
+
+// Reading as of a transaction vacuum is removing what it needs of fails
+// as soon as vacuum starts, not once it is done.
+func TestAsOf_duringVacuum(t *testing.T) {
+	database := newDatabase()
+
+	c := database.newConnection()
+	for _, value := range []string{"1", "2", "3"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+
+	// Vacuum waits for the store, after deciding what to remove.
+	database.storeMu.RLock()
+	vacuumed := make(chan VacuumStats)
+	go func() { vacuumed <- database.vacuum() }()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		database.txMu.RLock()
+		started := database.vacuumHorizon > 0
+		database.txMu.RUnlock()
+		if started {
+			break
+		}
+	}
+
+	_, err := c.execCommand("begin", []string{"asof", "1"})
+	assertEq(err, errSnapshotTooOld, "asof 1 during vacuum")
+	database.storeMu.RUnlock()
+	stats := <-vacuumed
+	assertEq(stats.versions, 2, "vacuumed versions")
+	_, err = c.execCommand("begin", []string{"asof", "1"})
+	assertEq(err, errSnapshotTooOld, "asof 1 after vacuum")
+}
+
+func TestAsOf_retainCommits(t *testing.T) {
+	database := newDatabase()
+	database.retainCommits = 2
+
+	c := database.newConnection()
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+	// Only the versions deleted before 4 are gone.
+	c.mustExecCommand("vacuum", nil)
+	assertEq(versionCount(&database, "x"), 3, "versions of x")
+
+	for _, txId := range []string{"4", "5"} {
+		c.mustExecCommand("begin", []string{"asof", txId})
+		res := c.mustExecCommand("get", []string{"x"})
+		assertEq(res, txId, "asof "+txId+" get x")
+		c.mustExecCommand("commit", nil)
+	}
+	_, err := c.execCommand("begin", []string{"asof", "3"})
+	assertEq(err, errSnapshotTooOld, "asof 3")
+}
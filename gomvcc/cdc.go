@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Change data capture. A subscriber is sent what every committed
+// transaction wrote to the keys with a prefix, with the value each key
+// had before, in the order the transactions committed. It is read from
+// the commit log, so aborted transactions are never sent, and a
+// subscriber can resume after any transaction it was sent.
+//
+// Each write is sent as a line
+//
+//	<txid> <op> <key> <old value> <new value>
+//
+// where op is insert, update or delete, values are quoted, and a value
+// that isn't there is sent as "-". After a transaction's writes comes
+// the line
+//
+//	<txid> commit
+//
+// Transactions that wrote none of the keys aren't sent.
+
+func (c change) op() string {
+	switch {
+	case c.deleted:
+		return "delete"
+	case c.existed:
+		return "update"
+	default:
+		return "insert"
+	}
+}
+
+func (c change) event(txId uint64) string {
+	before, after := "-", "-"
+	if c.existed {
+		before = strconv.Quote(c.oldValue)
+	}
+	if !c.deleted {
+		after = strconv.Quote(c.value)
+	}
+	return fmt.Sprintf("%d %s %s %s %s", txId, c.op(), c.key, before, after)
+}
+
+// The position in the commit log right after transaction txId's
+// record, or its start if txId is 0. The caller must hold txMu.
+func (d *Database) commitPositionAfterLocked(txId uint64) (int, error) {
+	if txId == 0 {
+		return 0, nil
+	}
+	for i := len(d.commitLog) - 1; i >= 0; i-- {
+		if d.commitLog[i].txId == txId {
+			return d.commitLogStart + i + 1, nil
+		}
+	}
+	if txId == d.commitLogStartAfter {
+		return d.commitLogStart, nil
+	}
+	// Every transaction that committed has a record, unless it
+	// was dropped.
+	if t, ok := d.transactions.Get(txId); ok && t.state == CommittedTransaction || !ok && txId < d.vacuumHorizon {
+		return 0, errPositionTooOld
+	}
+	return 0, fmt.Errorf("transaction %d is not in the commit log", txId)
+}
+
+// Sends what the transactions in the commit log from where reader is
+// on wrote to keys with prefix to w, and then what those that commit as
+// they do, until writing fails or done is closed.
+func (d *Database) streamChanges(w *bufio.Writer, prefix string, reader *commitReader, done <-chan struct{}) error {
+	for {
+		records, appended := d.readCommits(reader)
+		for _, r := range records {
+			sent := false
+			for _, c := range r.changes {
+				if !strings.HasPrefix(c.key, prefix) {
+					continue
+				}
+				if _, err := w.WriteString(c.event(r.txId) + "\n"); err != nil {
+					return err
+				}
+				sent = true
+			}
+			if sent {
+				if _, err := fmt.Fprintf(w, "%d commit\n", r.txId); err != nil {
+					return err
+				}
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-appended:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Starts reading the commit log for a subscription with subscribe's
+// arguments, and returns the prefix of the keys it is for. Without
+// from=<txid>, it starts with the next transaction to commit. With it,
+// it resumes after that transaction, as long as the commit log still
+// has what committed since; see retainCommitLog.
+func (d *Database) subscribe(args []string) (string, *commitReader, error) {
+	usage := badArgs("usage: subscribe [prefix] [from=<txid>]")
+	if len(args) > 2 {
+		return "", nil, usage
+	}
+	prefix, from := "", ""
+	if n := len(args); n > 0 && strings.HasPrefix(args[n-1], "from=") {
+		from = strings.TrimPrefix(args[n-1], "from=")
+		args = args[:n-1]
+	}
+	if len(args) == 2 {
+		return "", nil, usage
+	}
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	var txId uint64
+	if from != "" {
+		var err error
+		if txId, err = strconv.ParseUint(from, 10, 64); err != nil {
+			return "", nil, badArgs("not a transaction id: %q", from)
+		}
+	}
+
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	position := d.commitLogEndLocked()
+	if from != "" {
+		var err error
+		if position, err = d.commitPositionAfterLocked(txId); err != nil {
+			return "", nil, err
+		}
+	}
+	r, err := d.newCommitReaderLocked(position)
+	return prefix, r, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Reads the next n lines a subscriber is sent, joined by newlines.
+func (c *client) receive(n int) string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		line, err := c.r.ReadString('\n')
+		assertEq(err, nil, "receive")
+		lines = append(lines, line[:len(line)-1])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestSubscribe(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+	l := startServer(&database)
+	defer l.Close()
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"user1", "before"})
+	c.mustExecCommand("commit", nil)
+
+	s := dial(l)
+	defer s.conn.Close()
+	assertEq(s.send("subscribe user"), "OK", "subscribe")
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"user1", "a"})
+	c.mustExecCommand("set", []string{"user2", "b"})
+	c.mustExecCommand("set", []string{"other", "c"})
+	c.mustExecCommand("commit", nil)
+
+	// Neither aborted transactions, nor those writing none of the
+	// keys, nor what only existed inside a transaction, are sent.
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"user1", "lost"})
+	c.mustExecCommand("abort", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"user3", "lost"})
+	c.mustExecCommand("prepare", []string{"g"})
+	c.mustExecCommand("abortprepared", []string{"g"})
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"other", "d"})
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"user4", "lost"})
+	c.mustExecCommand("delete", []string{"user4"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("delete", []string{"user2"})
+	c.mustExecCommand("set", []string{"user1", "e"})
+	c.mustExecCommand("set", []string{"user1", "f"})
+	c.mustExecCommand("commit", nil)
+
+	assertEq(s.receive(6), strings.Join([]string{
+		`2 update user1 "before" "a"`,
+		`2 insert user2 - "b"`,
+		`2 commit`,
+		`7 update user1 "a" "f"`,
+		`7 delete user2 "b" -`,
+		`7 commit`,
+	}, "\n"), "events")
+}
+
+func TestSubscribe_resume(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+	c := database.newConnection()
+	for _, value := range []string{"1", "2", "3"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+	assertEq(database.close(), nil, "close")
+
+	// Old values are rebuilt with the commit log when the database
+	// is reopened. Only the last two commits are kept.
+	database = mustOpenDatabase(dir)
+	defer database.close()
+	database.retainCommitLog(2)
+	l := startServer(database)
+	defer l.Close()
+
+	s := dial(l)
+	defer s.conn.Close()
+	assertEq(s.send("subscribe from=1"), "OK", "subscribe from=1")
+	assertEq(s.receive(4), strings.Join([]string{
+		`2 update x "1" "2"`,
+		`2 commit`,
+		`3 update x "2" "3"`,
+		`3 commit`,
+	}, "\n"), "events after 1")
+
+	s2 := dial(l)
+	defer s2.conn.Close()
+	assertEq(s2.send("subscribe x from=0"), "ERR position too old", "subscribe from=0")
+	assertEq(s2.send("subscribe x from=2"), "OK", "subscribe from=2")
+	assertEq(s2.receive(2), strings.Join([]string{`3 update x "2" "3"`, `3 commit`}, "\n"), "events after 2")
+
+	s3 := dial(l)
+	defer s3.conn.Close()
+	assertEq(s3.send("subscribe from=7"), "ERR transaction 7 is not in the commit log", "subscribe from=7")
+	assertEq(s3.send("subscribe from=x"), `ERR not a transaction id: "x"`, "subscribe from=x")
+	assertEq(s3.send("subscribe a b"), "ERR usage: subscribe [prefix] [from=<txid>]", "subscribe a b")
+	assertEq(s3.send("begin"), "OK 4", "begin after refused subscriptions")
+	assertEq(s3.send("abort"), "OK", "abort")
+}
+
+// A subscriber that disconnects can resume from the last transaction it
+// saw, without the commit log being told to retain anything.
+func TestSubscribe_resumeAfterDisconnect(t *testing.T) {
+	database := newDatabase()
+	l := startServer(&database)
+	defer l.Close()
+
+	c := database.newConnection()
+	s := dial(l)
+	assertEq(s.send("subscribe"), "OK", "subscribe")
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+	assertEq(s.receive(2), strings.Join([]string{`1 insert x - "1"`, `1 commit`}, "\n"), "events")
+	s.conn.Close()
+
+	// Wait for the server to stop reading for it.
+	for {
+		database.txMu.RLock()
+		readers := len(database.commitReaders)
+		database.txMu.RUnlock()
+		if readers == 0 {
+			break
+		}
+		runtime.Gosched()
+	}
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "2"})
+	c.mustExecCommand("commit", nil)
+
+	s = dial(l)
+	defer s.conn.Close()
+	assertEq(s.send("subscribe from=1"), "OK", "subscribe from=1")
+	assertEq(s.receive(2), strings.Join([]string{`2 update x "1" "2"`, `2 commit`}, "\n"), "events after 1")
+}
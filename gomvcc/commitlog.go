@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A write made by a committed transaction.
+type change struct {
+	key       string
+	value     string
+	deleted   bool
+	expiresAt time.Time
+	// The value the write replaced, if there was one, which is the
+	// version of the key the transaction saw. It may have expired
+	// since.
+	oldValue string
+	existed  bool
+}
+
+// A committed transaction, and what it left of every key it wrote.
+type commitRecord struct {
+	txId    uint64
+	changes []change
+}
+
+// The last write to each key, in key order, with what the first one
+// replaced.
+func lastChanges(changes []change) []change {
+	first := map[string]change{}
+	last := map[string]change{}
+	for _, c := range changes {
+		if _, ok := first[c.key]; !ok {
+			first[c.key] = c
+		}
+		last[c.key] = c
+	}
+	result := make([]change, 0, len(last))
+	for key, c := range last {
+		c.oldValue, c.existed = first[key].oldValue, first[key].existed
+		result = append(result, c)
+	}
+	slices.SortFunc(result, func(a, b change) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return result
+}
+
+// The record of a transaction that committed changes. Deletes of keys
+// that weren't there, which a transaction that added and then deleted
+// a key leaves, are left out of it.
+func newCommitRecord(txId uint64, changes []change) commitRecord {
+	changes = lastChanges(changes)
+	kept := changes[:0]
+	for _, c := range changes {
+		if c.deleted && !c.existed {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return commitRecord{txId: txId, changes: kept}
+}
+
+var errPositionTooOld = errors.New("position too old")
+
+// How many commits the commit log keeps unless told otherwise, so that
+// a subscriber or replica that disconnects can resume from the last
+// transaction it saw, if not too many committed in between.
+const defaultCommitLogRetain = 1000
+
+// Replicas and subscribers read the commit log through a reader, which
+// keeps the records it is yet to read in the log. Positions count every
+// transaction that committed since the write-ahead log began, but the
+// log only keeps the records some reader is yet to read, and the last
+// commitLogRetain, so that it doesn't grow when nobody reads it.
+type commitReader struct {
+	position int
+}
+
+// Adds a transaction that just committed to the commit log, and wakes
+// up whoever waits for it. The caller must hold txMu for writing.
+func (d *Database) appendCommitLocked(txId uint64, changes []change) {
+	if len(d.commitReaders) == 0 && d.commitLogRetain == 0 && len(d.commitLog) == 0 {
+		// Nobody would read it.
+		d.commitLogStart++
+		d.commitLogStartAfter = txId
+		return
+	}
+	d.commitLog = append(d.commitLog, newCommitRecord(txId, changes))
+	d.trimCommitLogLocked()
+	close(d.commitAppended)
+	d.commitAppended = make(chan struct{})
+}
+
+// The position right after the last record. The caller must hold txMu.
+func (d *Database) commitLogEndLocked() int {
+	return d.commitLogStart + len(d.commitLog)
+}
+
+// Drops the records that every reader has read, except the last
+// commitLogRetain. The caller must hold txMu for writing.
+func (d *Database) trimCommitLogLocked() {
+	keep := max(d.commitLogStart, d.commitLogEndLocked()-d.commitLogRetain)
+	for r := range d.commitReaders {
+		keep = min(keep, r.position)
+	}
+	// What is left is copied, so that the memory of what is dropped
+	// can be reclaimed, which is only worth it once at least half
+	// of the log can go.
+	drop := keep - d.commitLogStart
+	if drop == 0 || drop < len(d.commitLog)/2 {
+		return
+	}
+	d.commitLogStartAfter = d.commitLog[drop-1].txId
+	d.commitLog = slices.Clone(d.commitLog[drop:])
+	d.commitLogStart = keep
+}
+
+// Keeps the last n records of the commit log for replicas and
+// subscribers to start from, besides those the ones reading it are yet
+// to read.
+func (d *Database) retainCommitLog(n int) {
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	d.commitLogRetain = n
+	d.trimCommitLogLocked()
+}
+
+// Starts reading the commit log from position. The caller must hold
+// txMu for writing.
+func (d *Database) newCommitReaderLocked(position int) (*commitReader, error) {
+	if position < d.commitLogStart {
+		return nil, errPositionTooOld
+	}
+	if position > d.commitLogEndLocked() {
+		return nil, errors.New("position is past the end of the commit log")
+	}
+	r := &commitReader{position: position}
+	d.commitReaders[r] = struct{}{}
+	return r, nil
+}
+
+func (d *Database) newCommitReader(position int) (*commitReader, error) {
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	return d.newCommitReaderLocked(position)
+}
+
+// The records from the reader's position on, and a channel that is
+// closed when more are added. They count as read from then on, so the
+// log may drop them.
+func (d *Database) readCommits(r *commitReader) ([]commitRecord, <-chan struct{}) {
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	// Records are never changed once added, so they can be used
+	// without the lock.
+	records := d.commitLog[r.position-d.commitLogStart : len(d.commitLog) : len(d.commitLog)]
+	r.position = d.commitLogEndLocked()
+	d.trimCommitLogLocked()
+	return records, d.commitAppended
+}
+
+// Stops reading the commit log, so that it stops keeping what the
+// reader is yet to read.
+func (d *Database) closeCommitReader(r *commitReader) {
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	delete(d.commitReaders, r)
+	d.trimCommitLogLocked()
+}
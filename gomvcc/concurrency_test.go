@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var allIsolationLevels = []IsolationLevel{
+	ReadUncommittedIsolation,
+	ReadCommittedIsolation,
+	RepeatableReadIsolation,
+	SnapshotIsolation,
+	SerializableIsolation,
+}
+
+// Runs fn on n goroutines at once, each with its own Connection.
+func runConcurrently(database *Database, n int, fn func(i int, c *Connection)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i, database.newConnection())
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Runs a write that may conflict with a concurrent transaction, which
+// aborts the transaction, and reports whether it didn't.
+func (c *Connection) mustWriteUnlessConflict(command string, args []string) bool {
+	_, err := c.execCommand(command, args)
+	if err != nil {
+		assert(errors.Is(err, ErrConflict), command+" only fails on conflicts")
+		return false
+	}
+	return true
+}
+
+func TestConcurrentIncrements(t *testing.T) {
+	for _, level := range allIsolationLevels {
+		t.Run(level.String(), func(t *testing.T) {
+			database := newDatabase()
+			database.defaultIsolation = level
+			database.startAutovacuum(50)
+			defer database.close()
+
+			var commits atomic.Int64
+			runConcurrently(&database, 8, func(i int, c *Connection) {
+				for j := 0; j < 100; j++ {
+					c.mustExecCommand("begin", nil)
+					n := 0
+					if res, err := c.execCommand("get", []string{"counter"}); err == nil {
+						n, err = strconv.Atoi(res)
+						assertEq(err, nil, "counter is a number")
+					}
+					if !c.mustWriteUnlessConflict("set", []string{"counter", strconv.Itoa(n + 1)}) {
+						continue
+					}
+					if _, err := c.execCommand("commit", nil); err == nil {
+						commits.Add(1)
+					}
+				}
+			})
+
+			c := database.newConnection()
+			c.mustExecCommand("begin", nil)
+			n, err := strconv.Atoi(c.mustExecCommand("get", []string{"counter"}))
+			assertEq(err, nil, "counter is a number")
+			assert(n > 0, "some increments are kept")
+
+			// Snapshot Isolation and stricter don't lose
+			// updates.
+			if level >= SnapshotIsolation {
+				assertEq(int64(n), commits.Load(), "increments")
+			} else {
+				assert(int64(n) <= commits.Load(), "no more increments than commits")
+			}
+		})
+	}
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	for _, level := range allIsolationLevels {
+		t.Run(level.String(), func(t *testing.T) {
+			database := newDatabase()
+			database.defaultIsolation = level
+
+			var commits atomic.Int64
+			runConcurrently(&database, 8, func(i int, c *Connection) {
+				for j := 0; j < 100; j++ {
+					c.mustExecCommand("begin", nil)
+					if !c.mustWriteUnlessConflict("incr", []string{"counter", "1"}) {
+						continue
+					}
+					if _, err := c.execCommand("commit", nil); err == nil {
+						commits.Add(1)
+					}
+				}
+			})
+
+			c := database.newConnection()
+			c.mustExecCommand("begin", nil)
+			n, err := strconv.Atoi(c.mustExecCommand("get", []string{"counter"}))
+			assertEq(err, nil, "counter is a number")
+
+			// Snapshot Isolation and stricter don't lose
+			// increments.
+			if level >= SnapshotIsolation {
+				assertEq(int64(n), commits.Load(), "increments")
+			} else {
+				assert(int64(n) <= commits.Load(), "no more increments than commits")
+			}
+		})
+	}
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	for _, level := range []IsolationLevel{RepeatableReadIsolation, SnapshotIsolation, SerializableIsolation} {
+		t.Run(level.String(), func(t *testing.T) {
+			database := newDatabase()
+			database.defaultIsolation = level
+			database.startAutovacuum(20)
+			defer database.close()
+
+			// Writers always set every key in a group to the same
+			// value, and readers must never see them differ.
+			runConcurrently(&database, 12, func(i int, c *Connection) {
+				group := fmt.Sprintf("g%d/", i%3)
+				for j := 0; j < 100; j++ {
+					c.mustExecCommand("begin", nil)
+					switch i % 4 {
+					case 0:
+						value := fmt.Sprintf("%d-%d", i, j)
+						for _, key := range []string{"a", "b", "c"} {
+							if !c.mustWriteUnlessConflict("set", []string{group + key, value}) {
+								break
+							}
+						}
+					case 1:
+						values := map[string]bool{}
+						for _, key := range []string{"a", "b", "c"} {
+							res, _ := c.execCommand("get", []string{group + key})
+							values[res] = true
+						}
+						assertEq(len(values), 1, "values in "+group)
+					case 2:
+						res := c.mustExecCommand("prefix", []string{group})
+						values := map[string]bool{}
+						for _, kv := range splitScan(res) {
+							values[kv[1]] = true
+						}
+						assert(len(values) <= 1, "values in "+group)
+					case 3:
+						if j%10 == 0 {
+							c.mustExecCommand("vacuum", nil)
+						}
+					}
+					c.execCommand("commit", nil)
+				}
+			})
+		})
+	}
+}
+
+// Splits the result of scan or prefix into key-value pairs.
+func splitScan(res string) [][2]string {
+	var kvs [][2]string
+	for _, kv := range strings.Fields(res) {
+		key, value, _ := strings.Cut(kv, "=")
+		kvs = append(kvs, [2]string{key, value})
+	}
+	return kvs
+}
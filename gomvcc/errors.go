@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by execCommand, which callers can check for with
+// errors.Is.
+var (
+	// The command needs a transaction, and none was begun.
+	ErrNoTransaction = errors.New("no transaction in progress")
+	// begin was called while a transaction is in progress.
+	ErrTransactionInProgress = errors.New("transaction already in progress")
+	// The command was given the wrong arguments.
+	ErrBadArgs = errors.New("bad arguments")
+	// The transaction was aborted because it conflicted with another
+	// one. errors.As gives the details as a *ConflictError, except
+	// for lock conflicts and deadlocks under two-phase locking.
+	ErrConflict = errors.New("conflict")
+)
+
+// A usage message, for a command given the wrong arguments.
+type argsError struct {
+	message string
+}
+
+func badArgs(format string, a ...any) error {
+	return &argsError{fmt.Sprintf(format, a...)}
+}
+
+func (e *argsError) Error() string {
+	return e.message
+}
+
+func (e *argsError) Unwrap() error {
+	return ErrBadArgs
+}
+
+// The conflict a transaction was aborted for.
+type ConflictError struct {
+	// "write-write" or "read-write".
+	kind string
+	// The transaction it conflicted with, and a key they both read or
+	// wrote.
+	txId uint64
+	key  string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s conflict with transaction %d on %q", e.kind, e.txId, e.key)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrors_misuse(t *testing.T) {
+	database := newDatabase()
+	c := database.newConnection()
+
+	for _, command := range []string{"get", "set", "delete", "scan", "commit", "abort", "savepoint", "rollback"} {
+		_, err := c.execCommand(command, []string{"x", "1"}[:commands[command].min])
+		assert(errors.Is(err, ErrNoTransaction), command)
+	}
+
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("begin", nil)
+	assert(errors.Is(err, ErrTransactionInProgress), "begin twice")
+	assertEq(err.Error(), "transaction already in progress", "begin twice")
+
+	// Nothing happened to the transaction.
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+}
+
+func TestErrors_badArgs(t *testing.T) {
+	database := newDatabase()
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+
+	for _, test := range []struct {
+		command string
+		args    []string
+		err     string
+	}{
+		{"get", nil, "usage: get <key>"},
+		{"set", []string{"x"}, "usage: set <key> <value> [ttl=<seconds>]"},
+		{"set", []string{"x", "1", "2"}, "usage: set <key> <value> [ttl=<seconds>]"},
+		{"scan", nil, "usage: scan <start> [end]"},
+		{"cas", []string{"x", "1"}, "usage: cas <key> <old> <new>"},
+		{"incr", []string{"x", "one"}, `not an integer: "one"`},
+		{"rollback", []string{"a"}, "usage: rollback to <savepoint>"},
+		{"show", []string{"everything"}, "usage: show transactions"},
+		{"vacuum", []string{"now"}, "usage: vacuum"},
+	} {
+		_, err := c.execCommand(test.command, test.args)
+		assert(errors.Is(err, ErrBadArgs), test.command)
+		assertEq(err.Error(), test.err, test.command)
+	}
+
+	// Arguments are checked before anything else.
+	c.mustExecCommand("commit", nil)
+	_, err := c.execCommand("begin", []string{"nope"})
+	assert(errors.Is(err, ErrBadArgs), "begin nope")
+	assertEq(err.Error(), `unknown isolation level "nope"`, "begin nope")
+	_, err = c.execCommand("begin", []string{"asof"})
+	assertEq(err.Error(), "usage: begin [level] [readonly] [asof <txid>]", "begin asof")
+	_, err = c.execCommand("commit", []string{"now"})
+	assert(errors.Is(err, ErrBadArgs), "commit now")
+}
+
+func TestErrors_conflict(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("commit", nil)
+
+	var conflict *ConflictError
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrConflict), "c2 commit")
+	assert(errors.As(err, &conflict), "c2 commit")
+	assertEq(*conflict, ConflictError{kind: "write-write", txId: 1, key: "x"}, "c2 conflict")
+
+	// So are deadlocks under two-phase locking.
+	locking := newLockingDatabase()
+	c5 := locking.newConnection()
+	c5.mustExecCommand("begin", nil)
+	c5.mustExecCommand("set", []string{"x", "1"})
+	c6 := locking.newConnection()
+	c6.mustExecCommand("begin", nil)
+	c6.mustExecCommand("set", []string{"y", "2"})
+
+	done := make(chan error)
+	go func() {
+		_, err := c5.execCommand("get", []string{"y"})
+		done <- err
+	}()
+	waitUntilBlocked(locking, c5.tx.id)
+
+	_, err = c6.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrConflict), "c6 get x")
+	assertEq(err.Error(), "deadlock detected", "c6 get x")
+	// c6 aborted, so c5 gets through, and doesn't see its write.
+	assertEq((<-done).Error(), "key not found", "c5 get y")
+	c5.mustExecCommand("commit", nil)
+
+	// Errors that aren't misuse or conflicts are none of these.
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	_, err = c4.execCommand("get", []string{"z"})
+	assert(!errors.Is(err, ErrConflict) && !errors.Is(err, ErrBadArgs), "c4 get z")
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A command run on a connection, from when it was invoked to when it
+// completed.
+type historyOp struct {
+	// Connections are numbered in the order they first run a
+	// command.
+	process int
+	// The transaction the command ran in, if any.
+	txId    uint64
+	command string
+	args    []string
+	result  string
+	err     error
+	// Whether the transaction ended with this command, either by
+	// committing or aborting, or by being aborted because of it.
+	txDone bool
+
+	// Logical times at which the command was invoked and completed.
+	// complete is 0 while the command is running.
+	invoke   int
+	complete int
+}
+
+func (op historyOp) String() string {
+	s := fmt.Sprintf("%d %d %s", op.process, op.txId, strings.Join(append([]string{op.command}, op.args...), " "))
+	if op.complete == 0 {
+		return s + " ..."
+	}
+	if op.err != nil {
+		return s + " -> ERR " + op.err.Error()
+	}
+	return s + " -> OK " + op.result
+}
+
+type history struct {
+	mu        sync.Mutex
+	clock     int
+	processes map[*Connection]int
+	ops       []*historyOp
+}
+
+func newHistory() *history {
+	return &history{processes: map[*Connection]int{}}
+}
+
+func (h *history) invoke(c *Connection, command string, args []string) *historyOp {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	process, ok := h.processes[c]
+	if !ok {
+		process = len(h.processes)
+		h.processes[c] = process
+	}
+
+	h.clock++
+	op := &historyOp{
+		process: process,
+		command: command,
+		args:    append([]string{}, args...),
+		invoke:  h.clock,
+	}
+	if c.tx != nil {
+		op.txId = c.tx.id
+	}
+	h.ops = append(h.ops, op)
+	return op
+}
+
+func (h *history) complete(op *historyOp, c *Connection, result string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clock++
+	op.complete = h.clock
+	op.result = result
+	op.err = err
+	if op.txId == 0 && c.tx != nil {
+		op.txId = c.tx.id
+	}
+	op.txDone = op.txId != 0 && c.tx == nil
+}
+
+// Recorded commands in the order they were invoked.
+func (h *history) operations() []historyOp {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ops := make([]historyOp, len(h.ops))
+	for i, op := range h.ops {
+		ops[i] = *op
+	}
+	return ops
+}
+
+// Checking histories
+//
+// Like Elle (https://github.com/jepsen-io/elle), the checker infers
+// the dependencies between committed transactions from what they read
+// and wrote, and looks for the cycles Adya's isolation levels rule out:
+//
+//   - G0: a cycle of write-write dependencies.
+//   - G1a: reading a value written by a transaction that aborted.
+//   - G1b: reading a value its writer overwrote before committing.
+//   - G1c: a cycle of write-write and write-read dependencies.
+//   - G-single: a cycle with exactly one read-write anti-dependency.
+//   - G2: a cycle with more than one anti-dependency.
+//
+// It also reports lost updates, where two transactions read the same
+// version of a key and then both wrote it. They are G-single cycles
+// too, but Snapshot Isolation rules them out by name.
+//
+// This needs every value written to a key to be different, so a read
+// tells which write it saw. The order of a key's versions is only
+// known where a transaction read the key before writing it, so blind
+// writes can't be ordered. Deletes aren't tracked, and reads of keys
+// that were never found only count as reads of the initial state if
+// the key is never deleted. Predicates aren't tracked either: a scan
+// reads the keys it returns. Writes rolled back to a savepoint count as
+// aborted.
+
+type dependency uint8
+
+const (
+	wwDependency dependency = 1 << iota
+	wrDependency
+	rwDependency
+
+	allDependencies = wwDependency | wrDependency | rwDependency
+)
+
+func (d dependency) String() string {
+	switch {
+	case d&wwDependency != 0:
+		return "ww"
+	case d&wrDependency != 0:
+		return "wr"
+	case d&rwDependency != 0:
+		return "rw"
+	}
+	return "none"
+}
+
+type historyAnomaly struct {
+	kind        string
+	description string
+}
+
+func (a historyAnomaly) String() string {
+	return a.kind + ": " + a.description
+}
+
+// A version of a key. Initial is the state before anything was
+// written to it.
+type version struct {
+	key     string
+	value   string
+	initial bool
+}
+
+func (v version) String() string {
+	if v.initial {
+		return v.key + "=<initial>"
+	}
+	return fmt.Sprintf("%s=%q", v.key, v.value)
+}
+
+type historyTransaction struct {
+	id    uint64
+	state TransactionState
+	// When its commit completed, if it committed.
+	committed int
+	// Versions of other transactions the transaction read.
+	reads []version
+	// Values written to each key, in order.
+	writes map[string][]string
+	// The version each key was last read at before the transaction
+	// first wrote it.
+	readBeforeWrite map[string]version
+
+	// For each savepoint, how many values had been written to each
+	// key when it was made.
+	savepoints []historySavepoint
+	// Values written and then rolled back to a savepoint.
+	rolledBack []version
+}
+
+type historySavepoint struct {
+	name   string
+	writes map[string]int
+}
+
+// The position of the latest savepoint with the name, or -1.
+func (t *historyTransaction) findSavepoint(name string) int {
+	i := len(t.savepoints) - 1
+	for i >= 0 && t.savepoints[i].name != name {
+		i--
+	}
+	return i
+}
+
+type dependencyGraph map[uint64]map[uint64]dependency
+
+func (g dependencyGraph) add(from, to uint64, d dependency) {
+	if from == to {
+		return
+	}
+	if g[from] == nil {
+		g[from] = map[uint64]dependency{}
+	}
+	g[from][to] |= d
+}
+
+func (g dependencyGraph) successors(id uint64) []uint64 {
+	var ids []uint64
+	for next := range g[id] {
+		ids = append(ids, next)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// The shortest path from one transaction to another following only
+// allowed dependencies between transactions in within, as the list of
+// transactions on it, or nil if there is none.
+func (g dependencyGraph) path(from, to uint64, allowed dependency, within map[uint64]bool) []uint64 {
+	previous := map[uint64]uint64{from: from}
+	queue := []uint64{from}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range g.successors(id) {
+			if g[id][next]&allowed == 0 || !within[next] {
+				continue
+			}
+			if _, seen := previous[next]; seen {
+				continue
+			}
+			previous[next] = id
+			if next == to {
+				path := []uint64{to}
+				for id := to; id != from; {
+					id = previous[id]
+					path = append([]uint64{id}, path...)
+				}
+				return path
+			}
+			queue = append(queue, next)
+		}
+	}
+	return nil
+}
+
+// Strongly connected components with more than one transaction, using
+// Tarjan's algorithm.
+func (g dependencyGraph) components() []map[uint64]bool {
+	var ids []uint64
+	for id := range g {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	index := map[uint64]int{}
+	lowlink := map[uint64]int{}
+	onStack := map[uint64]bool{}
+	var stack []uint64
+	var components []map[uint64]bool
+
+	var visit func(id uint64)
+	visit = func(id uint64) {
+		index[id] = len(index)
+		lowlink[id] = index[id]
+		stack = append(stack, id)
+		onStack[id] = true
+
+		for _, next := range g.successors(id) {
+			if _, seen := index[next]; !seen {
+				visit(next)
+				lowlink[id] = min(lowlink[id], lowlink[next])
+			} else if onStack[next] {
+				lowlink[id] = min(lowlink[id], index[next])
+			}
+		}
+
+		if lowlink[id] == index[id] {
+			component := map[uint64]bool{}
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component[top] = true
+				if top == id {
+					break
+				}
+			}
+			if len(component) > 1 {
+				components = append(components, component)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if _, seen := index[id]; !seen {
+			visit(id)
+		}
+	}
+	return components
+}
+
+// Describes a cycle, such as "1 -ww-> 2 -rw-> 1". The first dependency
+// is labelled first, and the others with the weakest dependency in
+// allowed between their transactions.
+func (g dependencyGraph) describe(cycle []uint64, first, allowed dependency) string {
+	var b strings.Builder
+	for i, id := range cycle {
+		fmt.Fprintf(&b, "%d", id)
+		if i == len(cycle)-1 {
+			break
+		}
+		d := first
+		if i > 0 {
+			d = g[id][cycle[i+1]] & allowed
+		}
+		fmt.Fprintf(&b, " -%s-> ", d)
+	}
+	return b.String()
+}
+
+// The weakest anomaly a strongly connected component contains.
+func (g dependencyGraph) classify(component map[uint64]bool) historyAnomaly {
+	var ids []uint64
+	for id := range component {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// A cycle through from, starting with a dependency of kind
+	// first, and otherwise only following allowed dependencies.
+	cycle := func(first, allowed dependency) []uint64 {
+		for _, from := range ids {
+			for _, to := range g.successors(from) {
+				if g[from][to]&first == 0 || !component[to] {
+					continue
+				}
+				if p := g.path(to, from, allowed, component); p != nil {
+					return append([]uint64{from}, p...)
+				}
+			}
+		}
+		return nil
+	}
+
+	if c := cycle(wwDependency, wwDependency); c != nil {
+		return historyAnomaly{"G0", g.describe(c, wwDependency, wwDependency)}
+	}
+	if c := cycle(wwDependency|wrDependency, wwDependency|wrDependency); c != nil {
+		return historyAnomaly{"G1c", g.describe(c, g[c[0]][c[1]]&(wwDependency|wrDependency), wwDependency|wrDependency)}
+	}
+	if c := cycle(rwDependency, wwDependency|wrDependency); c != nil {
+		return historyAnomaly{"G-single", g.describe(c, rwDependency, wwDependency|wrDependency)}
+	}
+	c := cycle(rwDependency, allDependencies)
+	return historyAnomaly{"G2", g.describe(c, rwDependency, allDependencies)}
+}
+
+// Finds the anomalies in a history. It fails if the history can't be
+// checked, such as when a value is written more than once.
+func checkHistory(ops []historyOp) ([]historyAnomaly, error) {
+	transactions := map[uint64]*historyTransaction{}
+	var order []*historyTransaction
+	deleted := map[string]bool{}
+
+	read := func(t *historyTransaction, v version) {
+		if len(t.writes[v.key]) > 0 {
+			// Reading its own writes.
+			return
+		}
+		t.reads = append(t.reads, v)
+		t.readBeforeWrite[v.key] = v
+	}
+
+	for _, op := range ops {
+		if op.txId == 0 || op.complete == 0 {
+			continue
+		}
+		t := transactions[op.txId]
+		if t == nil {
+			t = &historyTransaction{
+				id:              op.txId,
+				writes:          map[string][]string{},
+				readBeforeWrite: map[string]version{},
+			}
+			transactions[op.txId] = t
+			order = append(order, t)
+		}
+
+		switch op.command {
+		case "get":
+			if op.err == nil {
+				read(t, version{key: op.args[0], value: op.result})
+			} else if op.err.Error() == "key not found" {
+				read(t, version{key: op.args[0], initial: true})
+			}
+		case "scan", "prefix":
+			if op.err == nil {
+				for _, kv := range strings.Fields(op.result) {
+					key, value, _ := strings.Cut(kv, "=")
+					read(t, version{key: key, value: value})
+				}
+			}
+		case "set":
+			if op.err == nil {
+				t.writes[op.args[0]] = append(t.writes[op.args[0]], op.args[1])
+			}
+		case "delete":
+			if op.err == nil {
+				deleted[op.args[0]] = true
+			}
+		case "incr":
+			if op.err == nil {
+				// Whether the key was missing or 0 before can't
+				// be told apart, so only other values count as
+				// read.
+				n, _ := strconv.ParseInt(op.result, 10, 64)
+				delta, _ := strconv.ParseInt(op.args[1], 10, 64)
+				if n != delta {
+					read(t, version{key: op.args[0], value: strconv.FormatInt(n-delta, 10)})
+				}
+				t.writes[op.args[0]] = append(t.writes[op.args[0]], op.result)
+			}
+		case "cas":
+			if op.err == nil && op.result == "1" {
+				read(t, version{key: op.args[0], value: op.args[1]})
+				t.writes[op.args[0]] = append(t.writes[op.args[0]], op.args[2])
+			}
+		case "setnx":
+			if op.err == nil && op.result == "1" {
+				read(t, version{key: op.args[0], initial: true})
+				t.writes[op.args[0]] = append(t.writes[op.args[0]], op.args[1])
+			}
+		case "savepoint":
+			if op.err == nil {
+				writes := map[string]int{}
+				for key, values := range t.writes {
+					writes[key] = len(values)
+				}
+				t.savepoints = append(t.savepoints, historySavepoint{op.args[0], writes})
+			}
+		case "rollback":
+			if i := t.findSavepoint(op.args[len(op.args)-1]); op.err == nil && i >= 0 {
+				for key, values := range t.writes {
+					kept := t.savepoints[i].writes[key]
+					for _, value := range values[kept:] {
+						t.rolledBack = append(t.rolledBack, version{key: key, value: value})
+					}
+					t.writes[key] = values[:kept]
+				}
+				t.savepoints = t.savepoints[:i+1]
+			}
+		case "release":
+			if i := t.findSavepoint(op.args[0]); op.err == nil && i >= 0 {
+				t.savepoints = t.savepoints[:i]
+			}
+		}
+
+		if op.txDone {
+			t.state = AbortedTransaction
+			if op.command == "commit" && op.err == nil {
+				t.state = CommittedTransaction
+				t.committed = op.complete
+			}
+		}
+	}
+
+	// Who wrote each version.
+	type write struct {
+		t *historyTransaction
+		// Whether the writer overwrote it later.
+		intermediate bool
+		// Whether the writer rolled it back to a savepoint.
+		rolledBack bool
+	}
+	writes := map[version]write{}
+	add := func(v version, w write) error {
+		if other, ok := writes[v]; ok {
+			return fmt.Errorf("%s written by both %d and %d", v, other.t.id, w.t.id)
+		}
+		writes[v] = w
+		return nil
+	}
+	for _, t := range order {
+		for key, values := range t.writes {
+			for i, value := range values {
+				if err := add(version{key: key, value: value}, write{t: t, intermediate: i < len(values)-1}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, v := range t.rolledBack {
+			if err := add(v, write{t: t, rolledBack: true}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var anomalies []historyAnomaly
+	g := dependencyGraph{}
+	readers := map[version][]*historyTransaction{}
+	for _, t := range order {
+		if t.state != CommittedTransaction {
+			continue
+		}
+		for _, v := range t.reads {
+			if v.initial {
+				if !deleted[v.key] {
+					readers[v] = append(readers[v], t)
+				}
+				continue
+			}
+			w, ok := writes[v]
+			if !ok {
+				anomalies = append(anomalies, historyAnomaly{"garbage read", fmt.Sprintf("%d read %s, which was never written", t.id, v)})
+				continue
+			}
+			if w.t.state == AbortedTransaction {
+				anomalies = append(anomalies, historyAnomaly{"G1a", fmt.Sprintf("%d read %s written by %d, which aborted", t.id, v, w.t.id)})
+				continue
+			}
+			if w.rolledBack {
+				anomalies = append(anomalies, historyAnomaly{"G1a", fmt.Sprintf("%d read %s written by %d, which rolled it back", t.id, v, w.t.id)})
+				continue
+			}
+			if w.intermediate {
+				anomalies = append(anomalies, historyAnomaly{"G1b", fmt.Sprintf("%d read %s, which %d overwrote", t.id, v, w.t.id)})
+				continue
+			}
+			if w.t.state == CommittedTransaction {
+				g.add(w.t.id, t.id, wrDependency)
+				readers[v] = append(readers[v], t)
+			}
+		}
+	}
+
+	// A transaction that read a version before writing the key
+	// installed a later version. When several did, they installed
+	// theirs in the order they committed, so only the first
+	// installed the version right after the one they read, and
+	// each of the others the one right after the previous one's.
+	overwriters := map[version][]*historyTransaction{}
+	var overwritten []version
+	for _, t := range order {
+		if t.state != CommittedTransaction {
+			continue
+		}
+		for key, before := range t.readBeforeWrite {
+			if len(t.writes[key]) == 0 || before.initial && deleted[key] {
+				continue
+			}
+			if len(overwriters[before]) == 0 {
+				overwritten = append(overwritten, before)
+			}
+			overwriters[before] = append(overwriters[before], t)
+		}
+	}
+	for _, before := range overwritten {
+		ts := overwriters[before]
+		sort.Slice(ts, func(i, j int) bool { return ts[i].committed < ts[j].committed })
+		if w, ok := writes[before]; ok && w.t.state == CommittedTransaction && !w.intermediate {
+			g.add(w.t.id, ts[0].id, wwDependency)
+		}
+		for _, r := range readers[before] {
+			g.add(r.id, ts[0].id, rwDependency)
+		}
+		for i := 1; i < len(ts); i++ {
+			g.add(ts[i-1].id, ts[i].id, wwDependency)
+			anomalies = append(anomalies, historyAnomaly{"lost update", fmt.Sprintf("%d and %d both read %s and wrote %s", ts[i-1].id, ts[i].id, before, before.key)})
+		}
+	}
+
+	for _, component := range g.components() {
+		anomalies = append(anomalies, g.classify(component))
+	}
+	return anomalies, nil
+}
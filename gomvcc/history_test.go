@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newRecordedDatabase(level IsolationLevel) *Database {
+	database := newDatabase()
+	database.defaultIsolation = level
+	database.history = newHistory()
+	return &database
+}
+
+// The kinds of anomalies in the database's history, sorted and
+// separated by spaces.
+func anomalyKinds(database *Database) string {
+	anomalies, err := checkHistory(database.history.operations())
+	assertEq(err, nil, "check history")
+	var kinds []string
+	for _, a := range anomalies {
+		kinds = append(kinds, a.kind)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, " ")
+}
+
+func TestHistory_records(t *testing.T) {
+	database := newRecordedDatabase(ReadCommittedIsolation)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.execCommand("get", []string{"y"})
+	c1.mustExecCommand("commit", nil)
+
+	ops := database.history.operations()
+	assertEq(len(ops), 4, "operations")
+	for i, op := range ops {
+		assertEq(op.process, 0, "process")
+		assertEq(op.txId, uint64(1), "transaction")
+		assertEq(op.invoke, 2*i+1, "invoked")
+		assertEq(op.complete, 2*i+2, "completed")
+		assertEq(op.txDone, i == 3, "transaction done")
+	}
+	assertEq(ops[1].String(), "0 1 set x 1 -> OK 1", "set")
+	assertEq(ops[2].String(), "0 1 get y -> ERR key not found", "get")
+}
+
+func TestHistory_abortedRead(t *testing.T) {
+	database := newRecordedDatabase(ReadUncommittedIsolation)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "a"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("get", []string{"x"})
+
+	c1.mustExecCommand("abort", nil)
+	c2.mustExecCommand("commit", nil)
+
+	assertEq(anomalyKinds(database), "G1a", "anomalies")
+}
+
+func TestHistory_intermediateRead(t *testing.T) {
+	database := newRecordedDatabase(ReadUncommittedIsolation)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "a"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("get", []string{"x"})
+
+	c1.mustExecCommand("set", []string{"x", "b"})
+	c1.mustExecCommand("commit", nil)
+	c2.mustExecCommand("commit", nil)
+
+	assertEq(anomalyKinds(database), "G1b", "anomalies")
+}
+
+// Writes take no locks, so even Read Uncommitted transactions can
+// overwrite each other's writes in different orders.
+func TestHistory_writeCycle(t *testing.T) {
+	database := newRecordedDatabase(ReadUncommittedIsolation)
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "x0"})
+	c0.mustExecCommand("set", []string{"y", "y0"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("get", []string{"x"})
+	c1.mustExecCommand("set", []string{"x", "x1"})
+	c2.mustExecCommand("get", []string{"x"})
+	c2.mustExecCommand("set", []string{"x", "x2"})
+	c2.mustExecCommand("get", []string{"y"})
+	c2.mustExecCommand("set", []string{"y", "y2"})
+	c1.mustExecCommand("get", []string{"y"})
+	c1.mustExecCommand("set", []string{"y", "y1"})
+
+	c1.mustExecCommand("commit", nil)
+	c2.mustExecCommand("commit", nil)
+
+	assertEq(anomalyKinds(database), "G0", "anomalies")
+}
+
+// Two transactions read x, and then both write it. Whichever committed
+// second overwrote the first's write without seeing it.
+func TestHistory_lostUpdate(t *testing.T) {
+	database := newRecordedDatabase(RepeatableReadIsolation)
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "x0"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("get", []string{"x"})
+	c2.mustExecCommand("get", []string{"x"})
+	c1.mustExecCommand("set", []string{"x", "x1"})
+	c2.mustExecCommand("set", []string{"x", "x2"})
+	c2.mustExecCommand("commit", nil)
+	c1.mustExecCommand("commit", nil)
+
+	anomalies, err := checkHistory(database.history.operations())
+	assertEq(err, nil, "check history")
+	assertEq(len(anomalies), 2, "anomalies")
+	assertEq(anomalies[0].String(), `lost update: 3 and 2 both read x="x0" and wrote x`, "lost update")
+	assertEq(anomalies[1].String(), "G-single: 2 -rw-> 3 -ww-> 2", "cycle")
+}
+
+// A transaction reads x before another transaction changes x and y,
+// and y after.
+func readSkew(level IsolationLevel) string {
+	database := newRecordedDatabase(level)
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "x0"})
+	c0.mustExecCommand("set", []string{"y", "y0"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("get", []string{"x"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("get", []string{"x"})
+	c2.mustExecCommand("set", []string{"x", "x2"})
+	c2.mustExecCommand("get", []string{"y"})
+	c2.mustExecCommand("set", []string{"y", "y2"})
+	c2.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("get", []string{"y"})
+	c1.execCommand("commit", nil)
+
+	return anomalyKinds(database)
+}
+
+func TestHistory_readSkew(t *testing.T) {
+	assertEq(readSkew(ReadCommittedIsolation), "G-single", "read committed")
+	assertEq(readSkew(RepeatableReadIsolation), "", "repeatable read")
+}
+
+func TestHistory_writeSkew(t *testing.T) {
+	for _, level := range []IsolationLevel{SnapshotIsolation, SerializableIsolation} {
+		database := newRecordedDatabase(level)
+
+		c0 := database.newConnection()
+		c0.mustExecCommand("begin", nil)
+		c0.mustExecCommand("set", []string{"x", "x0"})
+		c0.mustExecCommand("set", []string{"y", "y0"})
+		c0.mustExecCommand("commit", nil)
+
+		c1 := database.newConnection()
+		c1.mustExecCommand("begin", nil)
+		c2 := database.newConnection()
+		c2.mustExecCommand("begin", nil)
+
+		for _, c := range []*Connection{c1, c2} {
+			c.mustExecCommand("get", []string{"x"})
+			c.mustExecCommand("get", []string{"y"})
+		}
+		c1.mustExecCommand("set", []string{"x", "x1"})
+		c2.mustExecCommand("set", []string{"y", "y2"})
+		c1.execCommand("commit", nil)
+		c2.execCommand("commit", nil)
+
+		expected := "G2"
+		if level == SerializableIsolation {
+			expected = ""
+		}
+		assertEq(anomalyKinds(database), expected, level.String())
+	}
+}
+
+func TestHistory_duplicateWrites(t *testing.T) {
+	database := newRecordedDatabase(ReadCommittedIsolation)
+
+	c := database.newConnection()
+	for i := 0; i < 2; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", "1"})
+		c.mustExecCommand("commit", nil)
+	}
+
+	_, err := checkHistory(database.history.operations())
+	assertEq(err.Error(), `x="1" written by both 1 and 2`, "check history")
+}
+
+// Transactions that read and increment a few keys, from many
+// connections at once.
+func runRandomTransactions(database *Database, seed int64) {
+	runConcurrently(database, 6, func(i int, c *Connection) {
+		r := rand.New(rand.NewSource(seed + int64(i)))
+		for j := 0; j < 100; j++ {
+			c.mustExecCommand("begin", nil)
+			for n := 0; n < 1+r.Intn(3) && c.tx != nil; n++ {
+				key := string(rune('a' + r.Intn(3)))
+				c.execCommand("get", []string{key})
+				runtime.Gosched()
+				if c.tx != nil && r.Intn(2) == 0 {
+					c.execCommand("set", []string{key, fmt.Sprintf("%d.%d.%d", i, j, n)})
+					runtime.Gosched()
+				}
+			}
+			if c.tx != nil {
+				c.execCommand("commit", nil)
+			}
+		}
+	})
+}
+
+// The anomalies each level rules out. Writes take no locks, so Read
+// Uncommitted doesn't even rule out G0, and Repeatable Read doesn't
+// keep others from changing what was read.
+var proscribedAnomalies = map[IsolationLevel][]string{
+	ReadUncommittedIsolation: nil,
+	ReadCommittedIsolation:   {"G0", "G1a", "G1b", "G1c"},
+	RepeatableReadIsolation:  {"G0", "G1a", "G1b", "G1c"},
+	SnapshotIsolation:        {"G0", "G1a", "G1b", "G1c", "G-single", "lost update"},
+	SerializableIsolation:    {"G0", "G1a", "G1b", "G1c", "G-single", "G2", "lost update"},
+}
+
+func TestHistory_isolationLevels(t *testing.T) {
+	for _, level := range allIsolationLevels {
+		t.Run(level.String(), func(t *testing.T) {
+			database := newRecordedDatabase(level)
+			runRandomTransactions(database, 1)
+
+			anomalies, err := checkHistory(database.history.operations())
+			assertEq(err, nil, "check history")
+			for _, a := range anomalies {
+				assert(a.kind != "garbage read", a.String())
+				for _, kind := range proscribedAnomalies[level] {
+					assert(a.kind != kind, a.String())
+				}
+			}
+		})
+	}
+
+	t.Run("2pl", func(t *testing.T) {
+		database := newRecordedDatabase(ReadCommittedIsolation)
+		database.concurrency = TwoPhaseLocking
+		runRandomTransactions(database, 1)
+
+		anomalies, err := checkHistory(database.history.operations())
+		assertEq(err, nil, "check history")
+		assertEq(len(anomalies), 0, fmt.Sprint(anomalies))
+	})
+}
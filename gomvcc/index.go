@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tidwall/btree"
+)
+
+// A secondary index over the values of every key. Each version of a key
+// has an entry version with the same txStartId, txEndId and expiresAt,
+// whose value is the key, so entries are visible exactly when the
+// versions are.
+//
+// The index is guarded by storeMu like the store, and its own lock
+// guards the entries, as writes to different keys change it at the same
+// time. It is locked after the version chain being written.
+type index struct {
+	name    string
+	mu      sync.Mutex
+	entries btree.Map[string, *versionChain]
+}
+
+// Entries are ordered by value, and then by key.
+func entryKey(value, key string) string {
+	return value + "\x00" + key
+}
+
+// The name an entry goes by in read, write and scan sets, and in
+// locks. It can't clash with a key unless the key starts with a NUL.
+func indexKey(name, value, key string) string {
+	return indexPrefix(name, value) + key
+}
+
+func indexPrefix(name, value string) string {
+	return "\x00" + name + "\x00" + value + "\x00"
+}
+
+// Adds an entry version for a version of key.
+func (ix *index) add(key string, v Value) {
+	chain, ok := ix.entries.Get(entryKey(v.value, key))
+	if !ok {
+		chain = &versionChain{}
+		ix.entries.Set(entryKey(v.value, key), chain)
+	}
+	chain.versions = append(chain.versions, Value{txStartId: v.txStartId, txEndId: v.txEndId, value: key, expiresAt: v.expiresAt})
+}
+
+// Sets the txEndId of the entry for a version of key, given the
+// version as it was before its txEndId was set. Returns whether there
+// was such an entry.
+func (ix *index) setEnd(key string, v Value, txEndId uint64) bool {
+	chain, ok := ix.entries.Get(entryKey(v.value, key))
+	if !ok {
+		return false
+	}
+	for i := len(chain.versions) - 1; i >= 0; i-- {
+		e := &chain.versions[i]
+		if e.txStartId == v.txStartId && e.txEndId == v.txEndId {
+			e.txEndId = txEndId
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the latest entry version for a version of key.
+func (ix *index) remove(key string, v Value) {
+	chain, ok := ix.entries.Get(entryKey(v.value, key))
+	assert(ok, "entry exists")
+	for i := len(chain.versions) - 1; i >= 0; i-- {
+		if chain.versions[i].txStartId == v.txStartId {
+			chain.versions = append(chain.versions[:i], chain.versions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Indexes the values of every key as name. Versions already in the
+// store are indexed too.
+func (d *Database) createIndex(name string) error {
+	d.storeMu.Lock()
+	defer d.storeMu.Unlock()
+
+	if _, ok := d.indexes[name]; ok {
+		return fmt.Errorf("index %q already exists", name)
+	}
+	if err := d.log(walRecord{op: walCreateIndex, key: name}); err != nil {
+		return err
+	}
+	d.createIndexLocked(name)
+	return nil
+}
+
+// The caller must hold storeMu for writing.
+func (d *Database) createIndexLocked(name string) {
+	ix := &index{name: name}
+	d.store.Scan(func(key string, chain *versionChain) bool {
+		for _, v := range chain.versions {
+			ix.add(key, v)
+		}
+		return true
+	})
+	d.indexes[name] = ix
+}
+
+// Changes the entries of every index for a write to key, which closed
+// the versions in closed and, unless it was a delete, added created.
+// Returns the names of the entries written. The caller must hold
+// storeMu and the key's version chain.
+func (d *Database) updateIndexes(t *Transaction, key string, closed []Value, created *Value) []string {
+	var written []string
+	for _, ix := range d.indexes {
+		ix.mu.Lock()
+		for _, v := range closed {
+			assert(ix.setEnd(key, v, t.id), "entry exists")
+			written = append(written, indexKey(ix.name, v.value, key))
+		}
+		if created != nil {
+			ix.add(key, *created)
+			written = append(written, indexKey(ix.name, created.value, key))
+		}
+		ix.mu.Unlock()
+	}
+	return written
+}
+
+// Undoes what updateIndexes did for a write to key, given the version it
+// added, if any.
+func (d *Database) undoIndexes(t *Transaction, key string, closed []Value, created *Value) {
+	for _, ix := range d.indexes {
+		ix.mu.Lock()
+		if created != nil {
+			ix.remove(key, *created)
+		}
+		// Like the versions, unless another transaction has
+		// closed them since.
+		for j := len(closed) - 1; j >= 0; j-- {
+			ended := closed[j]
+			ended.txEndId = t.id
+			ix.setEnd(key, ended, closed[j].txEndId)
+		}
+		ix.mu.Unlock()
+	}
+}
+
+// The keys whose version visible to t has value, in key order.
+func (c *Connection) getBy(name, value string) ([]string, error) {
+	c.db.storeMu.RLock()
+	_, ok := c.db.indexes[name]
+	c.db.storeMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no index %q", name)
+	}
+
+	// Other transactions can't add entries for the value until we
+	// are done, under two-phase locking, or commit without
+	// conflicting with us, under Serializable.
+	r := prefixRange(indexPrefix(name, value))
+	if err := c.lockRange(r); err != nil {
+		return nil, err
+	}
+	c.tx.recordScan(r)
+
+	c.db.storeMu.RLock()
+	defer c.db.storeMu.RUnlock()
+	ix := c.db.indexes[name]
+
+	var candidates []string
+	ix.mu.Lock()
+	prefix := entryKey(value, "")
+	ix.entries.Ascend(prefix, func(entry string, chain *versionChain) bool {
+		if len(entry) < len(prefix) || entry[:len(prefix)] != prefix {
+			return false
+		}
+		if e, ok := c.db.visibleVersion(c.tx, chain.versions); ok {
+			candidates = append(candidates, e.value)
+		}
+		return true
+	})
+	ix.mu.Unlock()
+
+	// A key can have more than one version visible, when one was
+	// written over by a transaction that aborted after another had
+	// written over it too, and only the latest counts.
+	var keys []string
+	for _, key := range candidates {
+		chain, ok := c.db.store.Get(key)
+		if !ok {
+			continue
+		}
+		chain.mu.RLock()
+		v, ok := c.db.visibleVersion(c.tx, chain.versions)
+		chain.mu.RUnlock()
+		if ok && v.value == value {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Under two-phase locking, a write to key also locks the entries it is
+// about to change, so that getby can lock the entries it reads. The key
+// is locked already, so what it is written over can't change.
+func (c *Connection) lockIndexEntries(key string, command string, args []string, delta int64) error {
+	if c.db.concurrency != TwoPhaseLocking || c.tx.readonly {
+		return nil
+	}
+
+	var names []string
+	c.db.storeMu.RLock()
+	for name := range c.db.indexes {
+		names = append(names, name)
+	}
+	var current Value
+	var found bool
+	if chain, ok := c.db.store.Get(key); ok && len(names) > 0 {
+		chain.mu.RLock()
+		current, found = c.db.visibleVersion(c.tx, chain.versions)
+		chain.mu.RUnlock()
+	}
+	c.db.storeMu.RUnlock()
+
+	value, write, err := newValue(command, args, delta, current, found)
+	for _, name := range names {
+		if found {
+			if err := c.lock(indexKey(name, current.value, key), exclusiveLock); err != nil {
+				return err
+			}
+		}
+		if err == nil && write && command != "delete" {
+			if err := c.lock(indexKey(name, value, key), exclusiveLock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"a", "red"})
+	c0.mustExecCommand("set", []string{"b", "blue"})
+	c0.mustExecCommand("commit", nil)
+
+	// What is already there gets indexed.
+	c0.mustExecCommand("createindex", []string{"color"})
+	_, err := c0.execCommand("createindex", []string{"color"})
+	assertEq(err.Error(), `index "color" already exists`, "createindex twice")
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "a", "c1 getby red")
+	_, err = c1.execCommand("getby", []string{"size", "big"})
+	assertEq(err.Error(), `no index "size"`, "c1 getby size")
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"c", "red"})
+	c2.mustExecCommand("set", []string{"a", "blue"})
+	c2.mustExecCommand("incr", []string{"d", "1"})
+
+	// Entries follow the versions they are for.
+	res = c2.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "c", "c2 getby red")
+	res = c2.mustExecCommand("getby", []string{"color", "blue"})
+	assertEq(res, "a b", "c2 getby blue")
+	res = c2.mustExecCommand("getby", []string{"color", "1"})
+	assertEq(res, "d", "c2 getby 1")
+	res = c1.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "a", "c1 getby red")
+
+	c2.mustExecCommand("delete", []string{"c"})
+	res = c2.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "", "c2 getby red after delete")
+	c2.mustExecCommand("commit", nil)
+
+	res = c1.mustExecCommand("getby", []string{"color", "blue"})
+	assertEq(res, "b", "c1 getby blue")
+	c1.mustExecCommand("commit", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res = c3.mustExecCommand("getby", []string{"color", "blue"})
+	assertEq(res, "a b", "c3 getby blue")
+	res = c3.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "", "c3 getby red")
+}
+
+// Below Snapshot Isolation, writing over a version a concurrent
+// transaction wrote over too doesn't conflict.
+func TestIndex_abortedOverwrite(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+	database.mustExec("createindex", "color")
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "red"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "blue"})
+	c2.mustExecCommand("set", []string{"x", "green"})
+	c1.mustExecCommand("commit", nil)
+	c2.mustExecCommand("abort", nil)
+
+	// c2 aborted after writing over red too, but x is only blue.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	for color, keys := range map[string]string{"red": "", "blue": "x", "green": ""} {
+		res := c3.mustExecCommand("getby", []string{"color", color})
+		assertEq(res, keys, "c3 getby "+color)
+	}
+}
+
+// Two doctors are on call, at least one must stay on call, and who is
+// on call is only looked up through the index.
+func TestIndex_serializable(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+	database.mustExec("createindex", "oncall")
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"alice", "on"})
+	c0.mustExecCommand("set", []string{"bob", "on"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	res := c1.mustExecCommand("getby", []string{"oncall", "on"})
+	assertEq(res, "alice bob", "c1 getby on")
+	c1.mustExecCommand("set", []string{"alice", "off"})
+	res = c2.mustExecCommand("getby", []string{"oncall", "on"})
+	assertEq(res, "alice bob", "c2 getby on")
+	c2.mustExecCommand("set", []string{"bob", "off"})
+
+	c1.mustExecCommand("commit", nil)
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 2 on "\x00oncall\x00on\x00bob"`, "c2 commit")
+}
+
+func TestIndex_phantom(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+	database.mustExec("createindex", "shift")
+
+	// Each adds a doctor to shift 3 if it has fewer than two.
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	for _, c := range []*Connection{c1, c2} {
+		res := c.mustExecCommand("getby", []string{"shift", "3"})
+		assertEq(res, "", "getby 3")
+	}
+	c1.mustExecCommand("set", []string{"alice", "3"})
+	c2.mustExecCommand("set", []string{"bob", "3"})
+
+	c1.mustExecCommand("commit", nil)
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 1 on "\x00shift\x003\x00bob"`, "c2 commit")
+}
+
+func TestIndex_savepoint(t *testing.T) {
+	database := newDatabase()
+	database.mustExec("createindex", "color")
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "red"})
+	c1.mustExecCommand("savepoint", []string{"a"})
+	c1.mustExecCommand("set", []string{"x", "blue"})
+	c1.mustExecCommand("set", []string{"y", "blue"})
+	res := c1.mustExecCommand("getby", []string{"color", "blue"})
+	assertEq(res, "x y", "c1 getby blue")
+
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+	res = c1.mustExecCommand("getby", []string{"color", "blue"})
+	assertEq(res, "", "c1 getby blue after rollback")
+	res = c1.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "x", "c1 getby red after rollback")
+	assertEq(entryCount(&database, "color"), 1, "entries")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestIndex_vacuum(t *testing.T) {
+	database := newDatabase()
+	database.mustExec("createindex", "color")
+
+	c := database.newConnection()
+	for _, color := range []string{"red", "blue", "green"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", color})
+		c.mustExecCommand("commit", nil)
+	}
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "red"})
+	c.mustExecCommand("abort", nil)
+	assertEq(entryCount(&database, "color"), 4, "entries")
+
+	c.mustExecCommand("vacuum", nil)
+	assertEq(entryCount(&database, "color"), 1, "entries after vacuum")
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("getby", []string{"color", "green"})
+	assertEq(res, "x", "getby green")
+}
+
+func TestIndex_twoPhaseLocking(t *testing.T) {
+	database := newLockingDatabase()
+	database.mustExec("createindex", "color")
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "", "c1 getby red")
+
+	// Adding an entry c1 read waits for it, but others don't.
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "blue"})
+	done := make(chan struct{})
+	go func() {
+		c2.mustExecCommand("set", []string{"x", "red"})
+		close(done)
+	}()
+	waitUntilBlocked(database, c2.tx.id)
+
+	res = c1.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "", "c1 getby red again")
+	c1.mustExecCommand("commit", nil)
+	<-done
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestIndex_wal(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "red"})
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("createindex", []string{"color"})
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "red"})
+	c.mustExecCommand("commit", nil)
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	defer database.close()
+	c = database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("getby", []string{"color", "red"})
+	assertEq(res, "x y", "getby red")
+}
+
+// Runs a command outside of any transaction.
+func (d *Database) mustExec(command string, args ...string) string {
+	return d.newConnection().mustExecCommand(command, args)
+}
+
+// The number of entry versions in the index.
+func entryCount(database *Database, name string) int {
+	n := 0
+	database.indexes[name].entries.Scan(func(_ string, chain *versionChain) bool {
+		n += len(chain.versions)
+		return true
+	})
+	return n
+}
@@ -0,0 +1,287 @@
+package main
+
+import "sync"
+
+// How concurrent transactions are kept apart.
+type ConcurrencyControl uint8
+
+const (
+	// Transactions read from versions according to their isolation
+	// level, and conflicts are checked when they commit.
+	OptimisticConcurrency ConcurrencyControl = iota
+
+	// Strict two-phase locking: transactions take a shared lock on
+	// everything they read and an exclusive lock on everything they
+	// write, and keep them until they commit or abort. This is
+	// serializable whatever the isolation level, and reads always
+	// see the latest committed version.
+	TwoPhaseLocking
+)
+
+// How Snapshot Isolation and stricter find that concurrent transactions
+// wrote the same key. Only used with OptimisticConcurrency.
+type WriteConflictPolicy uint8
+
+const (
+	// The transaction that commits first wins, and the other one
+	// aborts when it tries to commit.
+	FirstCommitterWins WriteConflictPolicy = iota
+
+	// The transaction that writes first wins, like in Postgres:
+	// writers take an exclusive lock on the key until they finish,
+	// and fail as soon as they get it if a concurrent transaction
+	// has committed a write to the key.
+	FirstUpdaterWins
+)
+
+// Why a lock couldn't be taken. Unwraps to ErrConflict, as the
+// transaction is aborted for it.
+type lockError string
+
+func (e lockError) Error() string {
+	return string(e)
+}
+
+func (e lockError) Unwrap() error {
+	return ErrConflict
+}
+
+var (
+	errLockConflict error = lockError(abortLockConflict)
+	errDeadlock     error = lockError(abortDeadlock)
+)
+
+type lockMode uint8
+
+const (
+	sharedLock lockMode = iota
+	exclusiveLock
+)
+
+type lockManager struct {
+	mu sync.Mutex
+	// Broadcast whenever locks are released.
+	released *sync.Cond
+
+	// Holders of each key, and the lock they hold.
+	keys map[string]map[uint64]lockMode
+	// Ranges read by each transaction. These are shared locks on
+	// every key in the range, whether it exists yet or not, so
+	// that nobody can insert into them.
+	ranges map[uint64][]keyRange
+	// Keys each transaction holds a lock on.
+	held map[uint64][]string
+
+	// The transactions each waiting transaction waits for.
+	waitsFor map[uint64][]uint64
+}
+
+func newLockManager() *lockManager {
+	m := &lockManager{
+		keys:     map[string]map[uint64]lockMode{},
+		ranges:   map[uint64][]keyRange{},
+		held:     map[uint64][]string{},
+		waitsFor: map[uint64][]uint64{},
+	}
+	m.released = sync.NewCond(&m.mu)
+	return m
+}
+
+// Transactions other than txId that hold a lock conflicting with mode
+// on key.
+func (m *lockManager) keyBlockers(txId uint64, key string, mode lockMode) []uint64 {
+	var blockers []uint64
+	for holder, held := range m.keys[key] {
+		if holder != txId && (mode == exclusiveLock || held == exclusiveLock) {
+			blockers = append(blockers, holder)
+		}
+	}
+	if mode == exclusiveLock {
+		for holder, ranges := range m.ranges {
+			if holder == txId {
+				continue
+			}
+			for _, r := range ranges {
+				if r.contains(key) {
+					blockers = append(blockers, holder)
+					break
+				}
+			}
+		}
+	}
+	return blockers
+}
+
+// Transactions other than txId that hold an exclusive lock on a key
+// in r.
+func (m *lockManager) rangeBlockers(txId uint64, r keyRange) []uint64 {
+	var blockers []uint64
+	for key, holders := range m.keys {
+		if !r.contains(key) {
+			continue
+		}
+		for holder, held := range holders {
+			if holder != txId && held == exclusiveLock {
+				blockers = append(blockers, holder)
+			}
+		}
+	}
+	return blockers
+}
+
+// Whether waiting for blockers would make txId wait for itself.
+func (m *lockManager) wouldDeadlock(txId uint64, blockers []uint64) bool {
+	seen := map[uint64]bool{}
+	stack := append([]uint64{}, blockers...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == txId {
+			return true
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		stack = append(stack, m.waitsFor[id]...)
+	}
+	return false
+}
+
+// Waits until blockers returns nobody, unless that would deadlock, or
+// wait is false. Must be called with mu held.
+func (m *lockManager) waitFor(txId uint64, wait bool, blockers func() []uint64) error {
+	defer delete(m.waitsFor, txId)
+	for {
+		b := blockers()
+		if len(b) == 0 {
+			return nil
+		}
+		if !wait {
+			return errLockConflict
+		}
+		if m.wouldDeadlock(txId, b) {
+			return errDeadlock
+		}
+		m.waitsFor[txId] = b
+		m.released.Wait()
+	}
+}
+
+func (m *lockManager) lockKey(txId uint64, key string, mode lockMode, wait bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	holders := m.keys[key]
+	if held, ok := holders[txId]; ok && held >= mode {
+		return nil
+	}
+
+	err := m.waitFor(txId, wait, func() []uint64 {
+		return m.keyBlockers(txId, key, mode)
+	})
+	if err != nil {
+		return err
+	}
+
+	holders = m.keys[key]
+	if holders == nil {
+		holders = map[uint64]lockMode{}
+		m.keys[key] = holders
+	}
+	if _, ok := holders[txId]; !ok {
+		m.held[txId] = append(m.held[txId], key)
+	}
+	holders[txId] = mode
+	return nil
+}
+
+func (m *lockManager) lockRange(txId uint64, r keyRange, wait bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.waitFor(txId, wait, func() []uint64 {
+		return m.rangeBlockers(txId, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.ranges[txId] = append(m.ranges[txId], r)
+	return nil
+}
+
+func (m *lockManager) releaseAll(txId uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.held[txId] {
+		delete(m.keys[key], txId)
+		if len(m.keys[key]) == 0 {
+			delete(m.keys, key)
+		}
+	}
+	delete(m.held, txId)
+	delete(m.ranges, txId)
+	m.released.Broadcast()
+}
+
+// Whether transactions take locks at all. Under two-phase locking they
+// lock everything they read and write, and with FirstUpdaterWins only
+// what they write.
+func (d *Database) takesLocks(t *Transaction, mode lockMode) bool {
+	if t.readonly {
+		return false
+	}
+	if d.concurrency == TwoPhaseLocking {
+		return true
+	}
+	return d.writeConflicts == FirstUpdaterWins && mode == exclusiveLock
+}
+
+// Takes a lock for the transaction, if it takes locks. When the lock
+// can't be taken, the transaction is aborted so that it doesn't hold on
+// to the locks it already has.
+func (c *Connection) lock(key string, mode lockMode) error {
+	if !c.db.takesLocks(c.tx, mode) {
+		return nil
+	}
+	return c.abortOnLockError(c.db.locks.lockKey(c.tx.id, key, mode, !c.db.lockNoWait))
+}
+
+func (c *Connection) lockRange(r keyRange) error {
+	if !c.db.takesLocks(c.tx, sharedLock) {
+		return nil
+	}
+	return c.abortOnLockError(c.db.locks.lockRange(c.tx.id, r, !c.db.lockNoWait))
+}
+
+func (c *Connection) abortOnLockError(err error) error {
+	if err != nil {
+		c.db.completeTransaction(c.tx, AbortedTransaction, err.Error())
+		c.tx = nil
+	}
+	return err
+}
+
+// With FirstUpdaterWins, fails the transaction if a concurrent one has
+// committed a write to the key. Must be called with the key locked, so
+// no other concurrent transaction can write it before this one is done.
+func (c *Connection) checkFirstUpdater(key string) error {
+	if c.db.concurrency != OptimisticConcurrency || c.db.writeConflicts != FirstUpdaterWins || c.tx.isolation < SnapshotIsolation {
+		return nil
+	}
+
+	c.db.txMu.RLock()
+	conflict := c.db.findConflict(c.tx, func(t1, t2 *Transaction) (string, bool) {
+		return key, t2.writeset.Contains(key)
+	})
+	c.db.txMu.RUnlock()
+
+	if conflict != nil {
+		c.db.completeTransaction(c.tx, AbortedTransaction, abortWriteWriteConflict)
+		c.tx = nil
+		return conflict
+	}
+	return nil
+}
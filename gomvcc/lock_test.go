@@ -0,0 +1,414 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newLockingDatabase() *Database {
+	database := newDatabase()
+	database.concurrency = TwoPhaseLocking
+	return &database
+}
+
+// Waits until the transaction is waiting for a lock.
+func waitUntilBlocked(database *Database, txId uint64) {
+	for i := 0; i < 1000; i++ {
+		database.locks.mu.Lock()
+		_, waiting := database.locks.waitsFor[txId]
+		database.locks.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	panic("transaction never blocked")
+}
+
+func TestTwoPhaseLocking_writerWaitsForReader(t *testing.T) {
+	database := newLockingDatabase()
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	done := make(chan struct{})
+	go func() {
+		c2.mustExecCommand("set", []string{"x", "2"})
+		close(done)
+	}()
+	waitUntilBlocked(database, c2.tx.id)
+
+	// Reads keep seeing the same value until c1 is done.
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x again")
+	c1.mustExecCommand("commit", nil)
+
+	<-done
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestTwoPhaseLocking_sharedLocks(t *testing.T) {
+	database := newLockingDatabase()
+	database.lockNoWait = true
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	// Readers don't block each other.
+	for _, c := range []*Connection{c1, c2} {
+		_, err := c.execCommand("get", []string{"x"})
+		assertEq(err.Error(), "key not found", "get x")
+	}
+
+	c1.mustExecCommand("commit", nil)
+	c2.mustExecCommand("set", []string{"x", "1"})
+	c2.mustExecCommand("commit", nil)
+}
+
+// Locking is serializable even at Read Uncommitted, so nothing
+// uncommitted or aborted is read.
+func TestTwoPhaseLocking_readUncommitted(t *testing.T) {
+	database := newLockingDatabase()
+	database.defaultIsolation = ReadUncommittedIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("commit", nil)
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("set", []string{"y", "2"})
+	c1.mustExecCommand("abort", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	res := c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c2 get x")
+	_, err := c2.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c2 get y")
+	c2.mustExecCommand("commit", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", []string{"readonly"})
+	res = c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c3 get x")
+	c3.mustExecCommand("commit", nil)
+}
+
+func TestTwoPhaseLocking_noWait(t *testing.T) {
+	database := newLockingDatabase()
+	database.lockNoWait = true
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	_, err := c2.execCommand("get", []string{"x"})
+	assertEq(err, errLockConflict, "c2 get x")
+	assertEq(c2.tx, nil, "c2 is aborted")
+
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestTwoPhaseLocking_deadlock(t *testing.T) {
+	database := newLockingDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "2"})
+
+	done := make(chan error)
+	go func() {
+		_, err := c1.execCommand("get", []string{"y"})
+		done <- err
+	}()
+	waitUntilBlocked(database, c1.tx.id)
+
+	// Waiting for c1 would close the cycle.
+	_, err := c2.execCommand("get", []string{"x"})
+	assertEq(err, errDeadlock, "c2 get x")
+	assertEq(c2.tx, nil, "c2 is aborted")
+
+	// Which lets c1 go on, without c2's write.
+	err = <-done
+	assertEq(err.Error(), "key not found", "c1 get y")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestTwoPhaseLocking_phantom(t *testing.T) {
+	database := newLockingDatabase()
+	database.lockNoWait = true
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("scan", []string{"a", "c"})
+	assertEq(res, "", "c1 scan")
+
+	// Nobody can insert into a range that was scanned.
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	_, err := c2.execCommand("set", []string{"b", "1"})
+	assertEq(err, errLockConflict, "c2 set b")
+
+	// But outside of it is fine.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("set", []string{"c", "1"})
+	c3.mustExecCommand("commit", nil)
+
+	res = c1.mustExecCommand("scan", []string{"a", "c"})
+	assertEq(res, "", "c1 scan again")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestTwoPhaseLocking_lostUpdate(t *testing.T) {
+	for _, level := range allIsolationLevels {
+		t.Run(level.String(), func(t *testing.T) {
+			database := newLockingDatabase()
+			database.defaultIsolation = level
+			database.lockNoWait = true
+
+			c0 := database.newConnection()
+			c0.mustExecCommand("begin", nil)
+			c0.mustExecCommand("set", []string{"x", "0"})
+			c0.mustExecCommand("commit", nil)
+
+			c1 := database.newConnection()
+			c1.mustExecCommand("begin", nil)
+			c2 := database.newConnection()
+			c2.mustExecCommand("begin", nil)
+
+			c1.mustExecCommand("get", []string{"x"})
+			c2.mustExecCommand("get", []string{"x"})
+
+			// Whatever the isolation level, neither can write
+			// what the other has read.
+			_, err := c1.execCommand("set", []string{"x", "1"})
+			assertEq(err, errLockConflict, "c1 set x")
+			c2.mustExecCommand("set", []string{"x", "1"})
+			c2.mustExecCommand("commit", nil)
+		})
+	}
+}
+
+func newFirstUpdaterDatabase() *Database {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+	database.writeConflicts = FirstUpdaterWins
+	return &database
+}
+
+func TestFirstUpdaterWins_waitsForCommit(t *testing.T) {
+	database := newFirstUpdaterDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "2"})
+	done := make(chan error)
+	go func() {
+		_, err := c2.execCommand("set", []string{"x", "2"})
+		done <- err
+	}()
+	waitUntilBlocked(database, c2.tx.id)
+
+	// Reads don't wait.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	_, err := c3.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c3 get x")
+
+	// The first updater committed, so the second one fails.
+	c1.mustExecCommand("commit", nil)
+	err = <-done
+	assertEq(err.Error(), `write-write conflict with transaction 1 on "x"`, "c2 set x")
+	assertEq(c2.tx, nil, "c2 is aborted")
+
+	// And its locks are released.
+	c3.mustExecCommand("set", []string{"y", "3"})
+	c3.mustExecCommand("commit", nil)
+}
+
+func TestFirstUpdaterWins_waitsForAbort(t *testing.T) {
+	database := newFirstUpdaterDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	done := make(chan struct{})
+	go func() {
+		c2.mustExecCommand("set", []string{"x", "2"})
+		close(done)
+	}()
+	waitUntilBlocked(database, c2.tx.id)
+
+	// The first updater aborted, so the second one goes on.
+	c1.mustExecCommand("abort", nil)
+	<-done
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestFirstUpdaterWins_alreadyCommitted(t *testing.T) {
+	database := newFirstUpdaterDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err := c1.execCommand("set", []string{"x", "1"})
+	assertEq(err.Error(), `write-write conflict with transaction 2 on "x"`, "c1 set x")
+	assertEq(c1.tx, nil, "c1 is aborted")
+}
+
+func TestFirstUpdaterWins_noWait(t *testing.T) {
+	database := newFirstUpdaterDatabase()
+	database.lockNoWait = true
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	_, err := c2.execCommand("incr", []string{"x", "1"})
+	assertEq(err, errLockConflict, "c2 incr x")
+	assertEq(c2.tx, nil, "c2 is aborted")
+}
+
+func TestFirstUpdaterWins_readCommitted(t *testing.T) {
+	database := newFirstUpdaterDatabase()
+	database.defaultIsolation = ReadCommittedIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	done := make(chan struct{})
+	go func() {
+		c2.mustExecCommand("incr", []string{"x", "1"})
+		close(done)
+	}()
+	waitUntilBlocked(database, c2.tx.id)
+
+	// Read Committed waits too, but then writes on top of what was
+	// committed.
+	c1.mustExecCommand("commit", nil)
+	<-done
+	c2.mustExecCommand("commit", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res := c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "c3 get x")
+}
+
+// Read-modify-write increments of a few counters from many connections
+// at once. Returns the number of committed and of aborted transactions.
+func incrementCounters(database *Database, connections, increments int) (int64, int64) {
+	var commits, aborts atomic.Int64
+	runConcurrently(database, connections, func(i int, c *Connection) {
+		for j := 0; j < increments; j++ {
+			key := "counter" + strconv.Itoa((i+j)%4)
+			c.mustExecCommand("begin", nil)
+			n := 0
+			res, err := c.execCommand("get", []string{key})
+			if err == nil {
+				n, err = strconv.Atoi(res)
+				assertEq(err, nil, "counter is a number")
+			}
+			// Under two-phase locking, a failed lock aborts the
+			// transaction.
+			if c.tx != nil {
+				_, err = c.execCommand("set", []string{key, strconv.Itoa(n + 1)})
+			}
+			if c.tx != nil {
+				_, err = c.execCommand("commit", nil)
+			}
+			if err == nil {
+				commits.Add(1)
+			} else {
+				aborts.Add(1)
+			}
+		}
+	})
+	return commits.Load(), aborts.Load()
+}
+
+func TestTwoPhaseLocking_concurrentIncrements(t *testing.T) {
+	database := newLockingDatabase()
+	commits, _ := incrementCounters(database, 8, 100)
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	total := 0
+	for i := 0; i < 4; i++ {
+		n, err := strconv.Atoi(c.mustExecCommand("get", []string{"counter" + strconv.Itoa(i)}))
+		assertEq(err, nil, "counter is a number")
+		total += n
+	}
+	assertEq(int64(total), commits, "increments")
+}
+
+func BenchmarkIncrements(b *testing.B) {
+	run := func(b *testing.B, database *Database) {
+		b.ResetTimer()
+		_, aborts := incrementCounters(database, 8, b.N)
+		b.ReportMetric(float64(aborts)/float64(8*b.N), "aborts/op")
+	}
+
+	for _, level := range allIsolationLevels {
+		b.Run(level.String(), func(b *testing.B) {
+			database := newDatabase()
+			database.defaultIsolation = level
+			database.startAutovacuum(1000)
+			defer database.close()
+			run(b, &database)
+		})
+	}
+	for _, level := range []IsolationLevel{SnapshotIsolation, SerializableIsolation} {
+		b.Run(level.String()+"/first-updater-wins", func(b *testing.B) {
+			database := newFirstUpdaterDatabase()
+			database.defaultIsolation = level
+			database.startAutovacuum(1000)
+			defer database.close()
+			run(b, database)
+		})
+	}
+	b.Run("2pl", func(b *testing.B) {
+		database := newLockingDatabase()
+		database.startAutovacuum(1000)
+		defer database.close()
+		run(b, database)
+	})
+}
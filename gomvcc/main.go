@@ -1,9 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tidwall/btree"
 )
@@ -36,6 +44,19 @@ type Value struct {
 	txStartId uint64
 	txEndId   uint64
 	value     string
+	// Zero if the value never expires. See ttl.go.
+	expiresAt time.Time
+}
+
+func (v Value) String() string {
+	s := fmt.Sprintf("%q created by %d", v.value, v.txStartId)
+	if v.txEndId != 0 {
+		s += fmt.Sprintf(", deleted by %d", v.txEndId)
+	}
+	if !v.expiresAt.IsZero() {
+		s += ", expires at " + v.expiresAt.Format(time.RFC3339Nano)
+	}
+	return s
 }
 
 type TransactionState uint8
@@ -46,6 +67,18 @@ const (
 	CommittedTransaction
 )
 
+func (s TransactionState) String() string {
+	switch s {
+	case InProgressTransaction:
+		return "in progress"
+	case AbortedTransaction:
+		return "aborted"
+	case CommittedTransaction:
+		return "committed"
+	}
+	return fmt.Sprintf("TransactionState(%d)", s)
+}
+
 // Loosest isolation at the top, strictest isolation at the bottom.
 type IsolationLevel uint8
 
@@ -57,131 +90,555 @@ const (
 	SerializableIsolation
 )
 
+var isolationLevelNames = []string{
+	ReadUncommittedIsolation: "read-uncommitted",
+	ReadCommittedIsolation:   "read-committed",
+	RepeatableReadIsolation:  "repeatable-read",
+	SnapshotIsolation:        "snapshot",
+	SerializableIsolation:    "serializable",
+}
+
+func (l IsolationLevel) String() string {
+	if int(l) < len(isolationLevelNames) {
+		return isolationLevelNames[l]
+	}
+	return fmt.Sprintf("IsolationLevel(%d)", l)
+}
+
+func parseIsolationLevel(name string) (IsolationLevel, error) {
+	for l, n := range isolationLevelNames {
+		if n == name {
+			return IsolationLevel(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown isolation level %q", name)
+}
+
 type Transaction struct {
 	isolation IsolationLevel
 	id        uint64
 	state     TransactionState
+	// When the transaction began, by the database's clock.
+	begun time.Time
+
+	// Guards writeset, readset and scanset, which are updated by
+	// the transaction's own Connection and read by concurrent
+	// transactions when they commit.
+	mu sync.Mutex
 
 	// Used only by Repeatable Read and stricter.
-	inprogress btree.Set[uint64]
+	snapshot snapshot
 
-	// Used only by Snapshot Isolation and stricter.
+	// Checked only by Snapshot Isolation and stricter, but tracked
+	// at every level so that a stricter concurrent transaction can
+	// check against them.
 	writeset btree.Set[string]
 	readset  btree.Set[string]
+
+	// Ranges read by scan and prefix, so that keys inserted into
+	// them by concurrent transactions count as read too.
+	scanset []keyRange
+
+	// Savepoints, oldest first, and the writes made since the
+	// oldest of them. Only used by the transaction's own
+	// Connection.
+	savepoints []savepoint
+	undo       []undoRecord
+
+	// The writes made so far, in the order they were made, for the
+	// commit log. Only used by the transaction's own Connection
+	// until it commits.
+	changes []change
+
+	// Read-only transactions can't write, aren't tracked for
+	// conflicts, and never abort. Whatever their isolation level,
+	// they only see a snapshot, which even at Serializable may not
+	// fit into the serial order of the others.
+	readonly bool
+	// For transactions reading as of a past transaction, the
+	// commitSeq of that transaction, the smallest id of the
+	// transactions that hadn't committed by then, and when it
+	// committed.
+	asof        uint64
+	asofHorizon uint64
+	asofTime    time.Time
+
+	// Order in which committed transactions committed, starting
+	// at 1, and when they did, by the database's clock.
+	commitSeq   uint64
+	committedAt time.Time
+
+	// Set on commit to the commitSeq of the earliest transaction
+	// that committed before this one after overwriting something
+	// this one read, if any. See checkSerializable.
+	earliestOutConflict uint64
+
+	// The global id the transaction was prepared as, if it was.
+	// See twophase.go.
+	gid string
+	// Set while its commit record is being synced. It is still in
+	// progress, but has its commitSeq, and conflict checks treat it
+	// as committed.
+	committing bool
+	// Set while a replica applies a delete of its leader's. The
+	// leader deleted a value that was there, so the value must go
+	// even if it expired by the replica's clock since.
+	ignoreExpiry bool
+}
+
+// A range of keys from start up to, but not including, end. An empty
+// end means the range has no upper bound.
+type keyRange struct {
+	start string
+	end   string
+}
+
+func prefixRange(prefix string) keyRange {
+	// The end of the range is the smallest key greater than every
+	// key with the prefix: drop trailing 0xff bytes and increment
+	// the last byte left.
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) > 0 {
+		end[len(end)-1]++
+	}
+	return keyRange{start: prefix, end: string(end)}
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= r.start && (r.end == "" || key < r.end)
 }
 
+func (t *Transaction) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var scanset []string
+	for _, r := range t.scanset {
+		scanset = append(scanset, fmt.Sprintf("[%q, %q)", r.start, r.end))
+	}
+
+	return fmt.Sprintf("transaction %d (%s, %s) inprogress=%v readset=%v writeset=%v scanset=%v",
+		t.id, t.isolation, t.state, t.snapshot.xip, t.readset.Keys(), t.writeset.Keys(), scanset)
+}
+
+func (t *Transaction) recordRead(key string) {
+	if t.readonly {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readset.Insert(key)
+}
+
+func (t *Transaction) recordScan(r keyRange) {
+	if t.readonly {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scanset = append(t.scanset, r)
+}
+
+func (t *Transaction) recordWrite(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeset.Insert(key)
+}
+
+// The first of the keys that t has read, either directly or through a
+// range that includes it, if any.
+func (t *Transaction) readOf(keys btree.Set[string]) (string, bool) {
+	if key, ok := sharedItem(t.readset, keys); ok {
+		return key, true
+	}
+
+	for _, r := range t.scanset {
+		var read string
+		found := false
+		keys.Ascend(r.start, func(key string) bool {
+			read, found = key, r.contains(key)
+			return false
+		})
+		if found {
+			return read, true
+		}
+	}
+
+	return "", false
+}
+
+// Every version of a key, oldest first.
+type versionChain struct {
+	mu       sync.RWMutex
+	versions []Value
+}
+
+// A Database can be used from many goroutines at once, but each of its
+// Connections only from one at a time.
 type Database struct {
-	defaultIsolation  IsolationLevel
-	store             map[string][]Value
-	transactions      btree.Map[uint64, Transaction]
+	defaultIsolation IsolationLevel
+
+	concurrency    ConcurrencyControl
+	writeConflicts WriteConflictPolicy
+	// Used by TwoPhaseLocking and FirstUpdaterWins. Unless
+	// lockNoWait is set, taking a lock that conflicts with one held
+	// by another transaction waits for it to be released.
+	locks      *lockManager
+	lockNoWait bool
+
+	// Commands run against the database are recorded here, if set.
+	history *history
+
+	// Guards the set of keys in store. Anything reading or writing
+	// a version chain holds it for reading, and the chain's own
+	// lock, so different keys can be read and written at the same
+	// time. Vacuum holds it for writing.
+	storeMu sync.RWMutex
+	store   btree.Map[string, *versionChain]
+	// Secondary indexes by name, also guarded by storeMu.
+	indexes map[string]*index
+
+	// Guards everything below, and the state of every transaction.
+	// Transactions start, and commit or abort, while holding it for
+	// writing, so conflict checks are atomic with the commit.
+	txMu              sync.RWMutex
+	transactions      btree.Map[uint64, *Transaction]
 	nextTransactionId uint64
+	nextCommitSeq     uint64
+	// The ids of the transactions in progress.
+	active btree.Set[uint64]
+	// Transactions prepared for two-phase commit, by global id.
+	prepared map[string]*Transaction
+	// The commitSeqs of the transactions whose commit record is
+	// being synced, and a channel closed when one of them is
+	// published. See publishCommitLocked.
+	committing      btree.Set[uint64]
+	commitPublished chan struct{}
+	// What transactions committed from position commitLogStart
+	// on, in the order they committed, for the readers of the
+	// commit log. See commitlog.go.
+	commitLog      []commitRecord
+	commitLogStart int
+	// The transaction whose record was right before the start, if
+	// any was dropped.
+	commitLogStartAfter uint64
+	commitAppended      chan struct{}
+	commitReaders       map[*commitReader]struct{}
+	commitLogRetain     int
+
+	// Transactions below this id have been, or are being, removed
+	// from `transactions` by vacuum. See transactionState.
+	vacuumHorizon uint64
+	// The latest commitSeq of the transactions vacuum removed, or
+	// is removing, and the latest expiry of the expired versions it
+	// removed.
+	vacuumedCommitSeq uint64
+	vacuumedExpiresAt time.Time
+	// While vacuum runs, the versions that expired before this may
+	// be being removed.
+	vacuumingExpiredBefore time.Time
+
+	// Vacuum keeps what is needed to read as of any of the last
+	// this many committed transactions.
+	retainCommits uint64
+	// Held while vacuum runs, so one runs at a time.
+	vacuumMu sync.Mutex
+
+	// When non-zero, vacuum runs in the background after every this
+	// many completed transactions. See startAutovacuum.
+	autovacuumThreshold  uint64
+	completedSinceVacuum uint64
+	autovacuum           *autovacuumWorker
+
+	// Transactions completed since the database was opened, and
+	// the aborted ones by the reason they were aborted for.
+	committedCount uint64
+	abortedCount   map[string]uint64
+
+	// Set when the database was opened with openDatabase.
+	wal *wal
+
+	// Set on read replicas. See replication.go.
+	replica *replicaState
+
+	// Tells the time values expire by. time.Now if nil.
+	clock func() time.Time
 }
 
 func newDatabase() Database {
 	return Database{
 		defaultIsolation: ReadCommittedIsolation,
-		store:            map[string][]Value{},
+		locks:            newLockManager(),
+		abortedCount:     map[string]uint64{},
+		indexes:          map[string]*index{},
+		prepared:         map[string]*Transaction{},
+		commitAppended:   make(chan struct{}),
+		commitPublished:  make(chan struct{}),
+		commitReaders:    map[*commitReader]struct{}{},
+		commitLogRetain:  defaultCommitLogRetain,
 		// The `0` transaction id will be used to mean that
 		// the id was not set. So all valid transaction ids
 		// must start at 1.
 		nextTransactionId: 1,
+		nextCommitSeq:     1,
 	}
 }
 
-func (d *Database) inprogress() btree.Set[uint64] {
-	var ids btree.Set[uint64]
-	iter := d.transactions.Iter()
-	for ok := iter.First(); ok; ok = iter.Next() {
-		if iter.Value().state == InProgressTransaction {
-			ids.Insert(iter.Key())
-		}
-	}
-	return ids
+func (d *Database) newTransaction(isolation IsolationLevel, readonly bool) *Transaction {
+	// Allocating the id and taking the snapshot must be atomic, or
+	// a transaction with a smaller id could be missing from it.
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	return d.newTransactionLocked(isolation, readonly)
 }
 
-func (d *Database) newTransaction() *Transaction {
+func (d *Database) newTransactionLocked(isolation IsolationLevel, readonly bool) *Transaction {
 	t := Transaction{}
-	t.isolation = d.defaultIsolation
+	t.isolation = isolation
+	t.readonly = readonly
 	t.state = InProgressTransaction
 
+	// Everything before the id is in the snapshot, and nothing
+	// after.
+	t.snapshot = d.takeSnapshot()
+	t.begun = d.now()
+
 	// Assign and increment transaction id.
 	t.id = d.nextTransactionId
 	d.nextTransactionId++
 
-	// Store all inprogress transaction ids.
-	t.inprogress = d.inprogress()
-
 	// Add this transaction to history.
-	d.transactions.Set(t.id, t)
+	d.transactions.Set(t.id, &t)
+	d.active.Insert(t.id)
 
 	debug("starting transaction", t.id)
 
 	return &t
 }
 
-func (d *Database) completeTransaction(t *Transaction, state TransactionState) error {
+// Commits or aborts the transaction. reason is what the transaction is
+// aborted for, if it is, as counted by stats.
+func (d *Database) completeTransaction(t *Transaction, state TransactionState, reason string) error {
 	debug("completing transaction ", t.id)
 
+	d.txMu.Lock()
+	err := d.completeTransactionLocked(t, state, reason)
+	if err == nil && t.committing {
+		// Reads, and other commits, don't wait for the commit
+		// record to be synced.
+		w := d.wal
+		d.txMu.Unlock()
+		err = w.sync()
+		d.txMu.Lock()
+		err = d.publishCommitLocked(t, err)
+	}
+	if d.autovacuum != nil && d.completedSinceVacuum >= d.autovacuumThreshold {
+		d.autovacuum.request()
+	}
+	d.txMu.Unlock()
+
+	if d.concurrency == TwoPhaseLocking || d.writeConflicts == FirstUpdaterWins {
+		d.locks.releaseAll(t.id)
+	}
+
+	return err
+}
+
+func (d *Database) completeTransactionLocked(t *Transaction, state TransactionState, reason string) error {
+	// Whoever completes a prepared transaction first does.
+	if t.prepared() && (d.prepared[t.gid] != t || t.committing) {
+		return fmt.Errorf("no prepared transaction %q", t.gid)
+	}
+
 	if state == CommittedTransaction {
-		// Check for conflicts.
-
-		// Snapshot Isolation imposes the additional constraint that
-		// no transaction A may commit after writing any of the same
-		// keys as transaction B has written and committed during
-		// transaction A's life.
-		if t.isolation == SnapshotIsolation && d.hasConflict(t, func(t1, t2 *Transaction) bool {
-			// Check if the transaction has written to any key that
-			// another transaction has read or written.
-			return haveSharedItem(t1.writeset, t2.writeset)
-		}) {
-			d.completeTransaction(t, AbortedTransaction)
-			return fmt.Errorf("write-write conflict")
-		}
-
-		// Serializable Isolation imposes the additional constraint that
-		// no transaction A may commit after reading any of the same
-		// keys as transaction B has written and committed during
-		// transaction A's life, or vice-versa.
-		if t.isolation == SerializableIsolation && d.hasConflict(t, func(t1, t2 *Transaction) bool {
-			// Check if the transaction has written to any key that
-			// another transaction has read or written.
-			return haveSharedItem(t1.readset, t2.writeset) || haveSharedItem(t1.writeset, t2.readset)
-		}) {
-			d.completeTransaction(t, AbortedTransaction)
-			return fmt.Errorf("read-write conflict")
-		}
-	}
-
-	// Update transactions.
+		// A prepared transaction was checked when it was prepared,
+		// and took its place in the commit order then.
+		var earliestOutConflict uint64
+		if !t.prepared() {
+			var err error
+			if earliestOutConflict, err = d.checkCommitLocked(t); err != nil {
+				return err
+			}
+		}
+
+		// The transaction is only committed once the commit is
+		// durable. A prepared transaction stays prepared until it
+		// is. See publishCommitLocked.
+		t.committedAt = d.now()
+		if err := d.log(walRecord{op: walCommit, txId: t.id, committedAt: t.committedAt.UnixNano()}); err != nil {
+			if !t.prepared() {
+				d.completeTransactionLocked(t, AbortedTransaction, abortWALError)
+			}
+			return err
+		}
+
+		if !t.prepared() {
+			t.commitSeq = d.nextCommitSeq
+			d.nextCommitSeq++
+			t.earliestOutConflict = earliestOutConflict
+		}
+
+		// From here on, conflict checks treat it as committed.
+		if d.wal != nil {
+			t.committing = true
+			d.committing.Insert(t.commitSeq)
+			return nil
+		}
+	}
+
+	var err error
+	if state == AbortedTransaction {
+		// Transactions without a commit record are aborted on
+		// recovery anyway, so this is only informative, unless
+		// the transaction was prepared.
+		err = d.log(walRecord{op: walAbort, txId: t.id})
+	}
+
+	d.finishTransactionLocked(t, state, reason)
+	return err
+}
+
+// Updates transactions for one that completed.
+func (d *Database) finishTransactionLocked(t *Transaction, state TransactionState, reason string) {
 	t.state = state
-	d.transactions.Set(t.id, *t)
+	d.active.Delete(t.id)
+	if t.prepared() {
+		delete(d.prepared, t.gid)
+	}
+	d.completedSinceVacuum++
+	if state == CommittedTransaction {
+		d.committedCount++
+		d.appendCommitLocked(t.id, t.changes)
+	} else {
+		d.abortedCount[reason]++
+	}
+}
+
+// Publishes the commit of a transaction whose commit record was synced,
+// or failed to be, with err. Commits are published in the commit order,
+// so that nobody sees one committed before those ordered before it.
+// If the record failed to sync, a prepared transaction stays prepared,
+// and any other is aborted. The caller must hold txMu for writing.
+func (d *Database) publishCommitLocked(t *Transaction, err error) error {
+	for {
+		first, _ := d.committing.Min()
+		if first == t.commitSeq {
+			break
+		}
+		published := d.commitPublished
+		d.txMu.Unlock()
+		<-published
+		d.txMu.Lock()
+	}
 
-	return nil
+	t.committing = false
+	d.committing.Delete(t.commitSeq)
+	close(d.commitPublished)
+	d.commitPublished = make(chan struct{})
+	if err == nil {
+		d.finishTransactionLocked(t, CommittedTransaction, "")
+		return nil
+	}
+	if !t.prepared() {
+		d.completeTransactionLocked(t, AbortedTransaction, abortWALError)
+	}
+	return err
+}
+
+// Runs the checks a transaction must pass to commit. If it fails them,
+// it is aborted, and the conflict returned. Otherwise, returns the
+// earliestOutConflict it commits with.
+func (d *Database) checkCommitLocked(t *Transaction) (uint64, error) {
+	// Under two-phase locking, conflicting transactions never run
+	// at the same time, so there is nothing to check. Nor is there
+	// for read-only transactions, which write nothing and whose
+	// reads aren't tracked.
+	if d.concurrency != OptimisticConcurrency || t.readonly {
+		return 0, nil
+	}
+
+	// Which checks run depends only on the isolation level of the
+	// committing transaction. Concurrent transactions are compared
+	// through their read and write sets whatever level they run
+	// at, so a transaction gets its guarantees even when others run
+	// at a looser level, and never aborts just because another
+	// transaction asked for a stricter one.
+
+	// Snapshot Isolation imposes the additional constraint that no
+	// transaction A may commit after writing any of the same keys
+	// as transaction B has written and committed during transaction
+	// A's life. Serializable is at least as strict.
+	if t.isolation >= SnapshotIsolation {
+		// Check if the transaction has written to any key that
+		// another transaction has written.
+		if conflict := d.findConflict(t, func(t1, t2 *Transaction) (string, bool) {
+			return sharedItem(t1.writeset, t2.writeset)
+		}); conflict != nil {
+			d.completeTransactionLocked(t, AbortedTransaction, abortWriteWriteConflict)
+			return 0, conflict
+		}
+	}
+
+	// Serializable Isolation additionally aborts transactions that
+	// would make the history impossible to order serially.
+	earliestOutConflict, conflict := d.checkSerializable(t)
+	if t.isolation == SerializableIsolation && conflict != nil {
+		d.completeTransactionLocked(t, AbortedTransaction, abortReadWriteConflict)
+		return 0, conflict
+	}
+	return earliestOutConflict, nil
 }
 
-func (d *Database) transactionState(txId uint64) Transaction {
+func (d *Database) transactionState(txId uint64) TransactionState {
+	d.txMu.RLock()
+	defer d.txMu.RUnlock()
+	return d.transactionStateLocked(txId)
+}
+
+func (d *Database) transactionStateLocked(txId uint64) TransactionState {
 	t, ok := d.transactions.Get(txId)
+	if !ok && txId < d.vacuumHorizon {
+		// Vacuum only leaves versions behind that reference
+		// committed transactions, so that is all we can be
+		// asked about here.
+		return CommittedTransaction
+	}
 	assert(ok, "valid transaction")
-	return t
+	return t.state
 }
 
 func (d *Database) assertValidTransaction(t *Transaction) {
 	assert(t.id > 0, "valid id")
-	assert(d.transactionState(t.id).state == InProgressTransaction, "in progress")
+	assert(d.transactionState(t.id) == InProgressTransaction, "in progress")
 }
 
 func (d *Database) isvisible(t *Transaction, v Value) bool {
-	if t.isolation == ReadUncommittedIsolation {
+	if t.expired(v) {
+		return false
+	}
+	if t.asof > 0 {
+		return d.committedAsOf(v.txStartId, t.asof) && (v.txEndId == 0 || !d.committedAsOf(v.txEndId, t.asof))
+	}
+	// Two-phase locking keeps others from writing what we read
+	// until we are done, so we can read the latest committed
+	// versions, whatever the isolation level. Read-only
+	// transactions take no locks, so they read from their snapshot
+	// instead, and those without one the latest committed versions.
+	locking := d.concurrency == TwoPhaseLocking
+	if t.isolation == ReadUncommittedIsolation && !locking {
 		return v.txEndId == 0
 	}
-	if t.isolation == ReadCommittedIsolation {
+	if t.isolation <= ReadCommittedIsolation || locking && !t.readonly {
 		// should not see values not created by self that is not committed
-		if v.txStartId != t.id && d.transactionState(v.txStartId).state != CommittedTransaction {
+		if v.txStartId != t.id && d.transactionState(v.txStartId) != CommittedTransaction {
 			return false
 		}
 
 		// should not see values that have been deleted by self or other committed transactions
-		if v.txEndId > 0 && (v.txEndId == t.id || d.transactionState(v.txEndId).state == CommittedTransaction) {
+		if v.txEndId > 0 && (v.txEndId == t.id || d.transactionState(v.txEndId) == CommittedTransaction) {
 			return false
 		}
 
@@ -204,145 +661,589 @@ func (d *Database) isvisible(t *Transaction, v Value) bool {
 	}
 
 	// ignore values created from transactions in progress when this one started
-	if t.inprogress.Contains(v.txStartId) {
+	if t.snapshot.inProgress(v.txStartId) {
 		return false
 	}
 
 	// values created by aborted transactions should not be visible.
-	if d.transactionState(v.txStartId).state == AbortedTransaction {
+	if d.transactionState(v.txStartId) == AbortedTransaction {
 		return false
 	}
 
 	// values created by our own transaction is visible.
 
+	// values deleted by our own transaction should not be visible.
+	if v.txEndId == t.id {
+		return false
+	}
+
 	if v.txEndId > 0 && // deleted / deleting state
-		v.txEndId <= t.id && // only consider result from transactions that started before this one or this one
-		!t.inprogress.Contains(v.txEndId) && // only consider result from transactions not in progress when this one started
-		d.transactionState(v.txEndId).state == CommittedTransaction { // those transactions must be committed
+		v.txEndId < t.id && // only consider result from transactions that started before this one
+		!t.snapshot.inProgress(v.txEndId) && // only consider result from transactions not in progress when this one started
+		d.transactionState(v.txEndId) == CommittedTransaction { // those transactions must be committed
 		return false
 	}
 
-	if t.isolation == RepeatableReadIsolation {
-		return true
+	// Repeatable Read, Snapshot Isolation and Serializable all read
+	// from the same snapshot. They only differ in the checks done
+	// in completeTransaction.
+	return true
+}
+
+// The newest version visible to t, if any.
+func (d *Database) visibleVersion(t *Transaction, versions []Value) (Value, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		debug(v, t, d.isvisible(t, v))
+		if d.isvisible(t, v) {
+			return v, true
+		}
 	}
-	// if t.isolation == RepeatableReadIsolation {
-	// 	return v.txEndId <= t.id || !t.inprogress.Contains(v.txStartId)
-	// }
-	// if t.isolation == SnapshotIsolation {
-	// 	return v.txEndId <= t.id || !t.writeset.Contains(v.value)
-	// }
-	// if t.isolation == SerializableIsolation {
-	// 	return v.txEndId <= t.id
-	// }
-	panic("unreachable")
+	return Value{}, false
 }
 
-func (d *Database) hasConflict(t1 *Transaction, conflictFn func(*Transaction, *Transaction) bool) bool {
+// Calls fn with every transaction that was running at some point
+// during t1's life and did not abort, while holding its lock. The
+// caller must hold txMu.
+func (d *Database) concurrentTransactions(t1 *Transaction, fn func(*Transaction)) {
+	call := func(t2 *Transaction) {
+		if t2.state == AbortedTransaction {
+			return
+		}
+		t2.mu.Lock()
+		defer t2.mu.Unlock()
+		fn(t2)
+	}
+
 	iter := d.transactions.Iter()
 
 	// iterate over inprogress transactions
-	inprogressIter := t1.inprogress.Iter()
-	for ok := inprogressIter.First(); ok; ok = inprogressIter.Next() {
-		id := inprogressIter.Key()
+	for _, id := range t1.snapshot.xip {
 		found := iter.Seek(id)
 		assert(found, "found")
-		t2 := iter.Value()
-		if t2.state == CommittedTransaction {
-			if conflictFn(t1, &t2) {
-				return true
-			}
-		}
+		call(iter.Value())
 	}
 
-	// iterate over all transactions that after before this one
-	for id := t1.id; id < d.nextTransactionId; id++ {
+	// iterate over all transactions that started after this one
+	for id := t1.id + 1; id < d.nextTransactionId; id++ {
 		found := iter.Seek(id)
 		assert(found, "found")
-		t2 := iter.Value()
-		if t2.state == CommittedTransaction {
-			if conflictFn(t1, &t2) {
-				return true
+		call(iter.Value())
+	}
+}
+
+// The first committed, or prepared, transaction concurrent with t1 that conflictFn
+// finds a key both of them wrote in, as a write-write conflict, if any.
+// The caller must hold txMu.
+func (d *Database) findConflict(t1 *Transaction, conflictFn func(*Transaction, *Transaction) (string, bool)) *ConflictError {
+	var conflict *ConflictError
+	d.concurrentTransactions(t1, func(t2 *Transaction) {
+		if conflict != nil || !t2.committedOrPrepared() {
+			return
+		}
+		if key, ok := conflictFn(t1, t2); ok {
+			conflict = &ConflictError{kind: "write-write", txId: t2.id, key: key}
+		}
+	})
+	return conflict
+}
+
+// Serializable Snapshot Isolation, as described by Cahill et al. and
+// implemented in Postgres.
+//
+// Under Snapshot Isolation a transaction A that reads a key which a
+// concurrent transaction B overwrites must be ordered before B, even
+// if B commits first. That is a read-write antidependency, A -rw-> B.
+// Every history that Snapshot Isolation allows but that can't be
+// ordered serially contains a pivot transaction with two consecutive
+// antidependencies, T1 -rw-> pivot -rw-> T3, where T3 is the first of
+// the three to commit (T1 and T3 may be the same transaction).
+//
+// This is called when t is about to commit, so t is the last of the
+// three to commit that we know of. It returns the commitSeq of the
+// earliest committed transaction t has an out-conflict to, so that
+// transactions committing after t can look for t as a pivot, and,
+// if committing t would complete a dangerous structure, the
+// antidependency of t that completes it.
+func (d *Database) checkSerializable(t *Transaction) (uint64, *ConflictError) {
+	var earliestOutConflict uint64
+	var inConflicts []*Transaction
+	var inConflictKeys []string
+	var committedPivot *ConflictError
+
+	d.concurrentTransactions(t, func(t2 *Transaction) {
+		// t -rw-> t2
+		if key, ok := t.readOf(t2.writeset); ok && t2.committedOrPrepared() {
+			if earliestOutConflict == 0 || t2.commitSeq < earliestOutConflict {
+				earliestOutConflict = t2.commitSeq
+			}
+
+			// t2 is a pivot whose own T3 committed before it,
+			// and so before t.
+			if t2.earliestOutConflict > 0 && committedPivot == nil {
+				committedPivot = &ConflictError{kind: "read-write", txId: t2.id, key: key}
+			}
+		}
+
+		// t2 -rw-> t
+		if key, ok := t2.readOf(t.writeset); ok {
+			inConflicts = append(inConflicts, t2)
+			inConflictKeys = append(inConflictKeys, key)
+		}
+	})
+
+	if committedPivot != nil {
+		return earliestOutConflict, committedPivot
+	}
+
+	// t is the pivot. It is only dangerous if T3 committed before
+	// T1 did, or T1 is yet to commit.
+	if earliestOutConflict > 0 {
+		for i, t1 := range inConflicts {
+			if !t1.committedOrPrepared() || t1.commitSeq >= earliestOutConflict {
+				return earliestOutConflict, &ConflictError{kind: "read-write", txId: t1.id, key: inConflictKeys[i]}
 			}
 		}
 	}
 
-	return false
+	return earliestOutConflict, nil
 }
 
 type Connection struct {
 	tx *Transaction
 	db *Database
+	// Set on the connection a replica applies what its leader
+	// committed through, the only one that may write to it.
+	applier bool
 }
 
 func (c *Connection) execCommand(command string, args []string) (string, error) {
 	debug(command, args)
 
+	if c.db.history == nil {
+		return c.exec(command, args)
+	}
+	op := c.db.history.invoke(c, command, args)
+	res, err := c.exec(command, args)
+	c.db.history.complete(op, c, res, err)
+	return res, err
+}
+
+// The arguments each command takes.
+type commandArgs struct {
+	min, max int
+	usage    string
+	// Whether the command runs in the connection's transaction.
+	inTransaction bool
+}
+
+var commands = map[string]commandArgs{
+	"vacuum":         {0, 0, "vacuum", false},
+	"stats":          {0, 0, "stats", false},
+	"show":           {1, 1, "show transactions", false},
+	"begin":          {0, 4, "begin [level] [readonly] [asof <txid>]", false},
+	"abort":          {0, 0, "abort", true},
+	"commit":         {0, 0, "commit", true},
+	"prepare":        {1, 1, "prepare <gid>", true},
+	"commitprepared": {1, 1, "commitprepared <gid>", false},
+	"abortprepared":  {1, 1, "abortprepared <gid>", false},
+	"get":            {1, 1, "get <key>", true},
+	"scan":           {1, 2, "scan <start> [end]", true},
+	"prefix":         {1, 1, "prefix <prefix>", true},
+	"set":            {2, 3, "set <key> <value> [ttl=<seconds>]", true},
+	"expire":         {2, 2, "expire <key> <seconds>", true},
+	"delete":         {1, 1, "delete <key>", true},
+	"incr":           {2, 2, "incr <key> <delta>", true},
+	"cas":            {3, 3, "cas <key> <old> <new>", true},
+	"setnx":          {2, 2, "setnx <key> <value>", true},
+	"savepoint":      {1, 1, "savepoint <name>", true},
+	"rollback":       {2, 2, "rollback to <savepoint>", true},
+	"release":        {1, 1, "release <savepoint>", true},
+	"createindex":    {1, 1, "createindex <name>", false},
+	"getby":          {2, 2, "getby <index> <value>", true},
+}
+
+func (c *Connection) exec(command string, args []string) (string, error) {
+	spec, ok := commands[command]
+	if !ok {
+		return "", fmt.Errorf("unimplemented")
+	}
+	if len(args) < spec.min || len(args) > spec.max {
+		return "", badArgs("usage: %s", spec.usage)
+	}
+	if spec.inTransaction && c.tx == nil {
+		return "", ErrNoTransaction
+	}
+	if command == "begin" && c.tx != nil {
+		return "", ErrTransactionInProgress
+	}
+
+	if command == "vacuum" {
+		stats := c.db.vacuum()
+		return fmt.Sprintf("versions=%d transactions=%d", stats.versions, stats.transactions), nil
+	}
+	if command == "stats" {
+		return c.db.stats().String(), nil
+	}
+	if command == "show" {
+		if args[0] != "transactions" {
+			return "", badArgs("usage: %s", spec.usage)
+		}
+		return c.db.showTransactions(), nil
+	}
 	if command == "begin" {
-		assertEq(c.tx, nil, "no transaction")
-		c.tx = c.db.newTransaction()
+		isolation := c.db.defaultIsolation
+		readonly := false
+		var asof uint64
+		asofGiven := false
+		for i := 0; i < len(args); i++ {
+			var err error
+			switch args[i] {
+			case "readonly":
+				readonly = true
+			case "asof":
+				i++
+				if i == len(args) {
+					return "", badArgs("usage: %s", spec.usage)
+				}
+				asof, err = strconv.ParseUint(args[i], 10, 64)
+				asofGiven = true
+			default:
+				isolation, err = parseIsolationLevel(args[i])
+			}
+			if err != nil {
+				return "", badArgs("%v", err)
+			}
+		}
+		if asofGiven {
+			tx, err := c.db.newTransactionAsOf(isolation, asof)
+			if err != nil {
+				return "", err
+			}
+			c.tx = tx
+		} else {
+			c.tx = c.db.newTransaction(isolation, readonly || c.db.replica != nil && !c.applier)
+		}
 		c.db.assertValidTransaction(c.tx)
+		if err := c.db.log(walRecord{op: walBegin, txId: c.tx.id}); err != nil {
+			c.db.completeTransaction(c.tx, AbortedTransaction, abortWALError)
+			c.tx = nil
+			return "", err
+		}
 		return fmt.Sprintf("%d", c.tx.id), nil
 	}
 	if command == "abort" {
 		c.db.assertValidTransaction(c.tx)
-		err := c.db.completeTransaction(c.tx, AbortedTransaction)
+		err := c.db.completeTransaction(c.tx, AbortedTransaction, abortRequested)
 		c.tx = nil
 		return "", err
 	}
 	if command == "commit" {
 		c.db.assertValidTransaction(c.tx)
-		err := c.db.completeTransaction(c.tx, CommittedTransaction)
+		err := c.db.completeTransaction(c.tx, CommittedTransaction, "")
 		c.tx = nil
 		return "", err
 	}
+	if command == "prepare" {
+		c.db.assertValidTransaction(c.tx)
+		// Prepared or not, the transaction is no longer the
+		// connection's. It is completed by its gid.
+		err := c.db.prepareTransaction(c.tx, args[0])
+		c.tx = nil
+		return "", err
+	}
+	if command == "commitprepared" {
+		return "", c.db.completePrepared(args[0], CommittedTransaction)
+	}
+	if command == "abortprepared" {
+		return "", c.db.completePrepared(args[0], AbortedTransaction)
+	}
 	if command == "get" {
 		c.db.assertValidTransaction(c.tx)
 		key := args[0]
-		c.tx.readset.Insert(key)
-		for i := len(c.db.store[key]) - 1; i >= 0; i-- {
-			v := c.db.store[key][i]
-			debug(v, c.tx, c.db.isvisible(c.tx, v))
-			if c.db.isvisible(c.tx, v) {
+		if err := c.lock(key, sharedLock); err != nil {
+			return "", err
+		}
+		c.tx.recordRead(key)
+
+		c.db.storeMu.RLock()
+		defer c.db.storeMu.RUnlock()
+		if chain, ok := c.db.store.Get(key); ok {
+			chain.mu.RLock()
+			defer chain.mu.RUnlock()
+			if v, ok := c.db.visibleVersion(c.tx, chain.versions); ok {
 				return v.value, nil
 			}
 		}
 		return "", fmt.Errorf("key not found")
 	}
-	if command == "delete" || command == "set" {
+	if command == "scan" || command == "prefix" {
+		c.db.assertValidTransaction(c.tx)
+		var r keyRange
+		if command == "prefix" {
+			r = prefixRange(args[0])
+		} else {
+			r = keyRange{start: args[0]}
+			if len(args) > 1 {
+				r.end = args[1]
+			}
+		}
+		if err := c.lockRange(r); err != nil {
+			return "", err
+		}
+		c.tx.recordScan(r)
+
+		// Visible key-value pairs in key order, separated by
+		// spaces.
+		var res []string
+		c.db.storeMu.RLock()
+		defer c.db.storeMu.RUnlock()
+		c.db.store.Ascend(r.start, func(key string, chain *versionChain) bool {
+			if !r.contains(key) {
+				return false
+			}
+			chain.mu.RLock()
+			defer chain.mu.RUnlock()
+			if v, ok := c.db.visibleVersion(c.tx, chain.versions); ok {
+				res = append(res, key+"="+v.value)
+			}
+			return true
+		})
+		return strings.Join(res, " "), nil
+	}
+	if command == "delete" || command == "set" || command == "incr" || command == "cas" || command == "setnx" || command == "expire" {
 		c.db.assertValidTransaction(c.tx)
 		key := args[0]
+		if c.tx.readonly {
+			return "", fmt.Errorf("transaction is read-only")
+		}
+		var delta int64
+		if command == "incr" {
+			var err error
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return "", badArgs("not an integer: %q", args[1])
+			}
+		}
+		var expiresAt time.Time
+		if command == "set" && len(args) == 3 || command == "expire" {
+			var err error
+			if command == "set" {
+				expiresAt, err = c.db.parseExpiry(args[2])
+			} else {
+				expiresAt, err = c.db.expiryIn(args[1])
+			}
+			if err != nil {
+				return "", err
+			}
+		}
 
-		// mark all visible versions as now invalid (why?)
-		found := false
-		for i := len(c.db.store[key]) - 1; i >= 0; i-- {
-			v := &c.db.store[key][i]
-			if c.db.isvisible(c.tx, *v) {
-				// assertEq(v.txEndId, 0, "end id") set the txEndId to all value if it is visible?
-				v.txEndId = c.tx.id
-				found = true
+		// Locks must be taken before anything in the store, as
+		// waiting for them would hold it up for everyone.
+		if err := c.lock(key, exclusiveLock); err != nil {
+			return "", err
+		}
+		if err := c.checkFirstUpdater(key); err != nil {
+			return "", err
+		}
+		if err := c.lockIndexEntries(key, command, args, delta); err != nil {
+			return "", err
+		}
+		// A conflict found below aborts the transaction once the
+		// store is unlocked, as that releases its locks.
+		var conflict *ConflictError
+		defer func() {
+			if conflict != nil {
+				c.db.completeTransaction(c.tx, AbortedTransaction, abortWriteWriteConflict)
+				c.tx = nil
+			}
+		}()
+
+		c.db.storeMu.RLock()
+		chain, ok := c.db.store.Get(key)
+		if !ok {
+			if command == "delete" {
+				c.db.storeMu.RUnlock()
+				return "", fmt.Errorf("key not found")
 			}
+
+			// Adding a key changes the store itself.
+			c.db.storeMu.RUnlock()
+			c.db.storeMu.Lock()
+			defer c.db.storeMu.Unlock()
+			chain, ok = c.db.store.Get(key)
+			if !ok {
+				chain = &versionChain{}
+				c.db.store.Set(key, chain)
+			}
+		} else {
+			defer c.db.storeMu.RUnlock()
+		}
+
+		// Writes to the same key happen one at a time, and are
+		// logged in the order they happen.
+		chain.mu.Lock()
+		defer chain.mu.Unlock()
+
+		if c.applier && command == "delete" {
+			c.tx.ignoreExpiry = true
+			defer func() { c.tx.ignoreExpiry = false }()
+		}
+
+		// Everything but set and delete depends on the visible
+		// version, so it counts as read for the conflict checks,
+		// and is evaluated against it while nobody else can
+		// write the key.
+		current, found := c.db.visibleVersion(c.tx, chain.versions)
+		if command != "set" && command != "delete" {
+			c.tx.recordRead(key)
+		}
+		value, write, err := newValue(command, args, delta, current, found)
+		if err != nil {
+			return "", err
 		}
-		if command == "delete" && !found {
-			return "", fmt.Errorf("key not found")
+		if !write {
+			return "0", nil
 		}
-		c.tx.writeset.Insert(key)
-		// add a new version if it's a set command
-		if command == "set" {
-			value := args[1]
-			c.db.store[key] = append(c.db.store[key], Value{
+		// set and expire give the value a new expiry, or none, and
+		// the others keep the one it had, except delete, which
+		// leaves no value.
+		if command != "set" && command != "expire" && command != "delete" {
+			expiresAt = current.expiresAt
+		}
+
+		// The versions the write closes are the visible ones, which
+		// recovery can't tell by itself, so they are logged.
+		var visible []int
+		var closes []uint64
+		for i := len(chain.versions) - 1; i >= 0; i-- {
+			v := chain.versions[i]
+			if !c.db.isvisible(c.tx, v) {
+				continue
+			}
+			// A snapshot can still see a version that a
+			// concurrent transaction closed. Closing it again
+			// would lose that transaction's write if this one
+			// aborted, and it couldn't commit anyway.
+			if c.tx.isolation >= SnapshotIsolation && v.txEndId != 0 && v.txEndId != c.tx.id && c.db.transactionState(v.txEndId) != AbortedTransaction {
+				conflict = &ConflictError{kind: "write-write", txId: v.txEndId, key: key}
+				return "", conflict
+			}
+			visible = append(visible, i)
+			closes = append(closes, v.txStartId)
+		}
+
+		record := walRecord{op: walDelete, txId: c.tx.id, key: key, closes: closes}
+		if command != "delete" {
+			record = walRecord{op: walSet, txId: c.tx.id, key: key, value: value, closes: closes}
+		}
+		if command != "delete" && !expiresAt.IsZero() {
+			record = walRecord{op: walExpiringSet, txId: c.tx.id, key: key, value: value, closes: closes, expiresAt: expiresAt.UnixNano()}
+		}
+		if err := c.db.log(record); err != nil {
+			return "", err
+		}
+
+		// mark all visible versions as now invalid (why?)
+		var closed []Value
+		for _, i := range visible {
+			v := &chain.versions[i]
+			// assertEq(v.txEndId, 0, "end id") set the txEndId to all value if it is visible?
+			closed = append(closed, *v)
+			v.txEndId = c.tx.id
+		}
+		c.tx.recordWrite(key)
+		c.tx.changes = append(c.tx.changes, change{key: key, value: value, deleted: command == "delete", expiresAt: expiresAt, oldValue: current.value, existed: found})
+		// Writes only need undoing back to the oldest savepoint.
+		if len(c.tx.savepoints) > 0 {
+			c.tx.undo = append(c.tx.undo, undoRecord{key: key, closed: closed, created: command != "delete"})
+		}
+		// add a new version unless it's a delete command
+		var created *Value
+		if command != "delete" {
+			created = &Value{
 				txStartId: c.tx.id,
 				txEndId:   0,
 				value:     value,
-			})
-
+				expiresAt: expiresAt,
+			}
+			chain.versions = append(chain.versions, *created)
+		}
+		for _, entry := range c.db.updateIndexes(c.tx, key, closed, created) {
+			c.tx.recordWrite(entry)
+		}
+		if command != "delete" {
+			switch command {
+			case "cas", "setnx", "expire":
+				return "1", nil
+			}
 			return value, nil
 		}
 		// delete ok
 		return "", nil
 	}
+	if command == "createindex" {
+		return "", c.db.createIndex(args[0])
+	}
+	if command == "getby" {
+		c.db.assertValidTransaction(c.tx)
+		keys, err := c.getBy(args[0], args[1])
+		return strings.Join(keys, " "), err
+	}
+	if command == "savepoint" {
+		c.db.assertValidTransaction(c.tx)
+		return "", c.savepoint(args[0])
+	}
+	if command == "rollback" {
+		c.db.assertValidTransaction(c.tx)
+		if args[0] != "to" {
+			return "", badArgs("usage: %s", spec.usage)
+		}
+		return "", c.rollbackTo(args[1])
+	}
+	if command == "release" {
+		c.db.assertValidTransaction(c.tx)
+		return "", c.release(args[0])
+	}
 	return "", fmt.Errorf("unimplemented")
 }
 
+// The value a write command writes over the version of the key visible
+// to the transaction, and whether it writes at all.
+func newValue(command string, args []string, delta int64, current Value, found bool) (string, bool, error) {
+	switch command {
+	case "delete":
+		if !found {
+			return "", false, fmt.Errorf("key not found")
+		}
+		return "", true, nil
+	case "incr":
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(current.value, 10, 64); err != nil {
+				return "", false, fmt.Errorf("value is not an integer")
+			}
+		}
+		return strconv.FormatInt(n+delta, 10), true, nil
+	case "cas":
+		if !found || current.value != args[1] {
+			return "", false, nil
+		}
+		return args[2], true, nil
+	case "expire":
+		if !found {
+			return "", false, nil
+		}
+		return current.value, true, nil
+	case "setnx":
+		if found {
+			return "", false, nil
+		}
+		return args[1], true, nil
+	}
+	return args[1], true, nil
+}
+
 func (c *Connection) mustExecCommand(cmd string, args []string) string {
 	res, err := c.execCommand(cmd, args)
 	assertEq(err, nil, "unexpected error")
@@ -356,20 +1257,123 @@ func (d *Database) newConnection() *Connection {
 	}
 }
 
-func haveSharedItem(s1 btree.Set[string], s2 btree.Set[string]) bool {
+// The first key in both sets, if any.
+func sharedItem(s1 btree.Set[string], s2 btree.Set[string]) (string, bool) {
 	s1Iter := s1.Iter()
 	s2Iter := s2.Iter()
 	for ok := s1Iter.First(); ok; ok = s1Iter.Next() {
 		s1Key := s1Iter.Key()
+		// Seek stops at the first key not less than s1Key, which
+		// may be a different key.
 		found := s2Iter.Seek(s1Key)
-		if found {
-			return true
+		if found && s2Iter.Key() == s1Key {
+			return s1Key, true
 		}
 	}
 
-	return false
+	return "", false
 }
 
 func main() {
-	panic("unimplemented")
+	addr := flag.String("addr", "localhost:5433", "address to listen on")
+	dir := flag.String("wal", "", "directory to keep the write-ahead log in, none if empty")
+	isolation := flag.String("isolation", ReadCommittedIsolation.String(), "isolation level of transactions started with a plain begin")
+	autovacuum := flag.Uint64("autovacuum", 0, "vacuum in the background after every this many transactions, never if 0")
+	retain := flag.Uint64("retain", 0, "keep the versions needed to begin asof any of the last this many committed transactions")
+	retainCommitLog := flag.Int("commit-log-retain", defaultCommitLogRetain, "keep the last this many commits for replicas and subscribers to start or resume from")
+	locking := flag.Bool("2pl", false, "use strict two-phase locking instead of checking for conflicts on commit")
+	firstUpdater := flag.Bool("first-updater-wins", false, "fail writes to keys that concurrent transactions wrote as soon as they are made, instead of on commit")
+	metrics := flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics, none if empty")
+	leader := flag.String("replica-of", "", "address of a leader to replicate, serving only read-only transactions, none if empty")
+	workloadNames := flag.String("workload", "", "run these comma-separated workloads, or all, at every isolation level and print the results, instead of serving")
+	seed := flag.Int64("seed", 1, "seed the workloads pick keys and clients with")
+	transactions := flag.Int("transactions", 10000, "transactions each workload runs")
+	interactive := flag.Bool("repl", false, "read commands for named connections from stdin instead of serving them")
+	flag.BoolVar(&DEBUG, "debug", DEBUG, "print debug output")
+	flag.Parse()
+
+	level, err := parseIsolationLevel(*isolation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *workloadNames != "" {
+		names := strings.Split(*workloadNames, ",")
+		if *workloadNames == "all" {
+			names = nil
+			for _, w := range workloads {
+				names = append(names, w.name)
+			}
+		}
+		if err := runWorkloads(os.Stdout, names, *seed, *transactions); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	database := newDatabase()
+	db := &database
+	if *leader != "" {
+		if *dir != "" {
+			log.Fatal("replicas can't have a write-ahead log")
+		}
+		db = newReplica()
+	}
+	if *dir != "" {
+		db, err = openDatabase(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.close()
+	}
+	db.defaultIsolation = level
+	if *autovacuum > 0 {
+		db.startAutovacuum(*autovacuum)
+	}
+	db.retainCommits = *retain
+	db.retainCommitLog(*retainCommitLog)
+	if *locking {
+		db.concurrency = TwoPhaseLocking
+	}
+	if *firstUpdater {
+		db.writeConflicts = FirstUpdaterWins
+	}
+
+	if *leader != "" {
+		conn, err := net.Dial("tcp", *leader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(db.replicate(conn))
+		}()
+	}
+
+	if *metrics != "" {
+		http.Handle("/metrics", metricsHandler(db))
+		go func() {
+			log.Fatal(http.ListenAndServe(*metrics, nil))
+		}()
+	}
+
+	if *interactive {
+		// Only prompt when a person is typing.
+		info, err := os.Stdin.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runREPL(db, os.Stdin, os.Stdout, info.Mode()&os.ModeCharDevice != 0); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", l.Addr())
+
+	s := newServer(db)
+	log.Fatal(s.serve(l))
 }
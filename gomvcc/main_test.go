@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -228,13 +229,46 @@ func TestSnapshotIsolation_writewrite_conflict(t *testing.T) {
 
 	res, err := c2.execCommand("commit", nil)
 	assertEq(res, "", "c2 commit")
-	assertEq(err.Error(), "write-write conflict", "c2 commit")
+	assertEq(err.Error(), `write-write conflict with transaction 1 on "x"`, "c2 commit")
 
 	// But unrelated keys cause no conflict.
 	c3.mustExecCommand("set", []string{"y", "no conflict"})
 	c3.mustExecCommand("commit", nil)
 }
 
+// A snapshot still sees a version a concurrent transaction deleted,
+// and writing over it again would bring it back if the writer aborted.
+func TestSnapshotIsolation_writeAfterConcurrentDelete(t *testing.T) {
+	for _, level := range []IsolationLevel{SnapshotIsolation, SerializableIsolation} {
+		database := newDatabase()
+		database.defaultIsolation = level
+
+		c0 := database.newConnection()
+		c0.mustExecCommand("begin", nil)
+		c0.mustExecCommand("set", []string{"x", "1"})
+		c0.mustExecCommand("commit", nil)
+
+		c1 := database.newConnection()
+		c1.mustExecCommand("begin", nil)
+		c2 := database.newConnection()
+		c2.mustExecCommand("begin", nil)
+		c1.mustExecCommand("delete", []string{"x"})
+		_, err := c2.execCommand("set", []string{"x", "2"})
+		assertEq(err.Error(), `write-write conflict with transaction 2 on "x"`, "c2 set x")
+		assertEq(c2.tx, nil, "c2 aborted")
+		c1.mustExecCommand("commit", nil)
+
+		// Neither now, nor after vacuum, is x back.
+		for _, when := range []string{"after commit", "after vacuum"} {
+			c0.mustExecCommand("begin", nil)
+			_, err = c0.execCommand("get", []string{"x"})
+			assertEq(err.Error(), "key not found", "get x "+when)
+			c0.mustExecCommand("commit", nil)
+			database.vacuum()
+		}
+	}
+}
+
 func TestSerializableIsolation_readwrite_conflict(t *testing.T) {
 	database := newDatabase()
 	database.defaultIsolation = SerializableIsolation
@@ -248,17 +282,615 @@ func TestSerializableIsolation_readwrite_conflict(t *testing.T) {
 	c3 := database.newConnection()
 	c3.mustExecCommand("begin", nil)
 
+	_, err := c1.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c1 get y")
 	c1.mustExecCommand("set", []string{"x", "hey"})
 	c1.mustExecCommand("commit", nil)
 
-	_, err := c2.execCommand("get", []string{"x"})
-	assertEq(err.Error(), "key not found", "c5 get x")
+	_, err = c2.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c2 get x")
+	c2.mustExecCommand("set", []string{"y", "hey"})
 
+	// Each read the key the other wrote, so neither can go
+	// first.
 	res, err := c2.execCommand("commit", nil)
 	assertEq(res, "", "c2 commit")
-	assertEq(err.Error(), "read-write conflict", "c2 commit")
+	assertEq(err.Error(), `read-write conflict with transaction 1 on "y"`, "c2 commit")
 
 	// But unrelated keys cause no conflict.
-	c3.mustExecCommand("set", []string{"y", "no conflict"})
+	c3.mustExecCommand("set", []string{"z", "no conflict"})
+	c3.mustExecCommand("commit", nil)
+}
+
+func TestSerializableIsolation_single_antidependency(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "hey"})
+	c1.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c2 get x")
+	c2.mustExecCommand("set", []string{"y", "yall"})
+
+	// c2 missed c1's write, but that is the same as running c2
+	// before c1.
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestSerializableIsolation_write_skew(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	// Two doctors are on call, at least one must stay on call.
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"alice", "on"})
+	c0.mustExecCommand("set", []string{"bob", "on"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	// Both see the other one on call, and go off call.
+	res := c1.mustExecCommand("get", []string{"bob"})
+	assertEq(res, "on", "c1 get bob")
+	c1.mustExecCommand("set", []string{"alice", "off"})
+
+	res = c2.mustExecCommand("get", []string{"alice"})
+	assertEq(res, "on", "c2 get alice")
+	c2.mustExecCommand("set", []string{"bob", "off"})
+
+	// c2 -rw-> c1 -rw-> c2 with c1 committing first.
+	c1.mustExecCommand("commit", nil)
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 2 on "bob"`, "c2 commit")
+}
+
+// From Fekete, O'Neil and O'Neil, "A Read-Only Transaction Anomaly
+// Under Snapshot Isolation".
+func TestSerializableIsolation_read_only_anomaly(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"checking", "0"})
+	c0.mustExecCommand("set", []string{"savings", "0"})
+	c0.mustExecCommand("commit", nil)
+
+	// Withdraws 10 from checking, with a penalty of 1 if the
+	// total balance goes negative.
+	withdraw := database.newConnection()
+	withdraw.mustExecCommand("begin", nil)
+	res := withdraw.mustExecCommand("get", []string{"checking"})
+	assertEq(res, "0", "withdraw get checking")
+	res = withdraw.mustExecCommand("get", []string{"savings"})
+	assertEq(res, "0", "withdraw get savings")
+
+	// Deposits 20 into savings.
+	deposit := database.newConnection()
+	deposit.mustExecCommand("begin", nil)
+	res = deposit.mustExecCommand("get", []string{"savings"})
+	assertEq(res, "0", "deposit get savings")
+	deposit.mustExecCommand("set", []string{"savings", "20"})
+	deposit.mustExecCommand("commit", nil)
+
+	// Prints the balances, and sees the deposit but not the
+	// withdrawal, so it can only go between the two.
+	report := database.newConnection()
+	report.mustExecCommand("begin", nil)
+	res = report.mustExecCommand("get", []string{"checking"})
+	assertEq(res, "0", "report get checking")
+	res = report.mustExecCommand("get", []string{"savings"})
+	assertEq(res, "20", "report get savings")
+	report.mustExecCommand("commit", nil)
+
+	// But the withdrawal charges the penalty, so it must go before
+	// the deposit.
+	withdraw.mustExecCommand("set", []string{"checking", "-11"})
+	_, err := withdraw.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 4 on "checking"`, "withdraw commit")
+}
+
+// Each anomaly scenario runs against a fresh database at the given
+// isolation level and reports whether the anomaly was observed.
+type anomaly func(level IsolationLevel) bool
+
+// A transaction reads a value written by another transaction that has
+// not committed yet.
+func dirtyRead(level IsolationLevel) bool {
+	database := newDatabase()
+	database.defaultIsolation = level
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "dirty"})
+
+	res, err := c2.execCommand("get", []string{"x"})
+	return err == nil && res == "dirty"
+}
+
+// A transaction reads the same key twice and sees a value committed by
+// another transaction in between.
+func nonRepeatableRead(level IsolationLevel) bool {
+	database := newDatabase()
+	database.defaultIsolation = level
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("commit", nil)
+
+	res = c1.mustExecCommand("get", []string{"x"})
+	return res != "1"
+}
+
+// Two transactions increment the same counter from the same starting
+// value and both commit, so one of the increments is lost.
+func lostUpdate(level IsolationLevel) bool {
+	database := newDatabase()
+	database.defaultIsolation = level
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "0"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "0", "c1 get x")
+	res = c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "0", "c2 get x")
+
+	c1.mustExecCommand("set", []string{"x", "1"})
+	// Snapshot Isolation and stricter fail the second write to x
+	// as soon as it is made.
+	if _, err := c2.execCommand("set", []string{"x", "1"}); err != nil {
+		assert(errors.Is(err, ErrConflict), "c2 set x conflicts")
+		return false
+	}
+
+	_, err1 := c1.execCommand("commit", nil)
+	_, err2 := c2.execCommand("commit", nil)
+	return err1 == nil && err2 == nil
+}
+
+// Two transactions each check that at least one of x and y is set, and
+// then each unset a different one of them. Both commit, breaking the
+// invariant neither of them broke on its own.
+func writeSkew(level IsolationLevel) bool {
+	database := newDatabase()
+	database.defaultIsolation = level
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("set", []string{"y", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	for _, c := range []*Connection{c1, c2} {
+		res := c.mustExecCommand("get", []string{"x"})
+		assertEq(res, "1", "get x")
+		res = c.mustExecCommand("get", []string{"y"})
+		assertEq(res, "1", "get y")
+	}
+
+	c1.mustExecCommand("set", []string{"x", "0"})
+	c2.mustExecCommand("set", []string{"y", "0"})
+
+	_, err1 := c1.execCommand("commit", nil)
+	_, err2 := c2.execCommand("commit", nil)
+	return err1 == nil && err2 == nil
+}
+
+func TestIsolationAnomalies(t *testing.T) {
+	anomalies := []struct {
+		name string
+		fn   anomaly
+	}{
+		{"dirty read", dirtyRead},
+		{"non-repeatable read", nonRepeatableRead},
+		{"lost update", lostUpdate},
+		{"write skew", writeSkew},
+	}
+
+	// Whether each anomaly, in the order above, is allowed.
+	levels := []struct {
+		name    string
+		level   IsolationLevel
+		allowed []bool
+	}{
+		{"read uncommitted", ReadUncommittedIsolation, []bool{true, true, true, true}},
+		{"read committed", ReadCommittedIsolation, []bool{false, true, true, true}},
+		{"repeatable read", RepeatableReadIsolation, []bool{false, false, true, true}},
+		{"snapshot", SnapshotIsolation, []bool{false, false, false, true}},
+		{"serializable", SerializableIsolation, []bool{false, false, false, false}},
+	}
+
+	for _, l := range levels {
+		for i, a := range anomalies {
+			t.Run(l.name+"/"+a.name, func(t *testing.T) {
+				assertEq(a.fn(l.level), l.allowed[i], l.name+" allows "+a.name)
+			})
+		}
+	}
+}
+
+func TestRepeatableRead_deleteVisibleToSelf(t *testing.T) {
+	for _, level := range []IsolationLevel{RepeatableReadIsolation, SnapshotIsolation, SerializableIsolation} {
+		database := newDatabase()
+		database.defaultIsolation = level
+
+		c1 := database.newConnection()
+		c1.mustExecCommand("begin", nil)
+		c1.mustExecCommand("set", []string{"x", "hey"})
+		c1.mustExecCommand("commit", nil)
+
+		c2 := database.newConnection()
+		c2.mustExecCommand("begin", nil)
+		c2.mustExecCommand("delete", []string{"x"})
+
+		// Our own delete is visible before commit.
+		res, err := c2.execCommand("get", []string{"x"})
+		assertEq(res, "", "c2 get x")
+		assertEq(err.Error(), "key not found", "c2 get x")
+
+		// A new value set after the delete is visible too.
+		c2.mustExecCommand("set", []string{"x", "yall"})
+		res = c2.mustExecCommand("get", []string{"x"})
+		assertEq(res, "yall", "c2 get x")
+
+		c2.mustExecCommand("commit", nil)
+	}
+}
+
+func TestBeginIsolationLevel(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = ReadCommittedIsolation
+
+	for _, level := range []IsolationLevel{
+		ReadUncommittedIsolation,
+		ReadCommittedIsolation,
+		RepeatableReadIsolation,
+		SnapshotIsolation,
+		SerializableIsolation,
+	} {
+		c := database.newConnection()
+		c.mustExecCommand("begin", []string{level.String()})
+		assertEq(c.tx.isolation, level, "begin "+level.String())
+		c.mustExecCommand("commit", nil)
+	}
+
+	// No level falls back to the database default.
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	assertEq(c.tx.isolation, ReadCommittedIsolation, "begin")
+	c.mustExecCommand("commit", nil)
+
+	_, err := c.execCommand("begin", []string{"read-whatever"})
+	assertEq(err.Error(), `unknown isolation level "read-whatever"`, "begin read-whatever")
+	assertEq(c.tx, nil, "no transaction after bad begin")
+}
+
+func TestMixedIsolation_readUncommittedSeesSnapshotWrites(t *testing.T) {
+	database := newDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", []string{"snapshot"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", []string{"read-uncommitted"})
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", []string{"repeatable-read"})
+
+	c1.mustExecCommand("set", []string{"x", "hey"})
+
+	// Visibility only depends on the reader's level.
+	res := c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "hey", "c2 get x")
+
+	_, err := c3.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c3 get x")
+
+	c1.mustExecCommand("commit", nil)
+
+	_, err = c3.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c3 get x")
+}
+
+func TestMixedIsolation_writewrite_conflict(t *testing.T) {
+	database := newDatabase()
+
+	// A snapshot transaction committing after a concurrent read
+	// committed one wrote the same key must abort.
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", []string{"read-committed"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", []string{"snapshot"})
+
+	c1.mustExecCommand("set", []string{"x", "hey"})
+	c1.mustExecCommand("commit", nil)
+
+	c2.mustExecCommand("set", []string{"x", "yall"})
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `write-write conflict with transaction 1 on "x"`, "c2 commit")
+
+	// But the read committed transaction committing last is not
+	// held to the snapshot transaction's guarantees.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", []string{"snapshot"})
+
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", []string{"read-committed"})
+
+	c3.mustExecCommand("set", []string{"x", "hey"})
+	c3.mustExecCommand("commit", nil)
+
+	c4.mustExecCommand("set", []string{"x", "yall"})
+	c4.mustExecCommand("commit", nil)
+
+	// Serializable also rejects write-write conflicts, even without
+	// reading the key first. As x is there by now, the write fails
+	// as soon as it is made.
+	c5 := database.newConnection()
+	c5.mustExecCommand("begin", []string{"snapshot"})
+
+	c6 := database.newConnection()
+	c6.mustExecCommand("begin", []string{"serializable"})
+
+	c5.mustExecCommand("set", []string{"x", "hey"})
+	c5.mustExecCommand("commit", nil)
+
+	_, err = c6.execCommand("set", []string{"x", "yall"})
+	assertEq(err.Error(), `write-write conflict with transaction 5 on "x"`, "c6 set x")
+	assertEq(c6.tx, nil, "c6 aborted")
+}
+
+func TestMixedIsolation_readwrite_conflict(t *testing.T) {
+	database := newDatabase()
+
+	// A serializable transaction in a write skew with a concurrent
+	// repeatable read transaction must abort.
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", []string{"serializable"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", []string{"repeatable-read"})
+
+	_, err := c2.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c2 get x")
+	c2.mustExecCommand("set", []string{"y", "hey"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err = c1.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c1 get y")
+	c1.mustExecCommand("set", []string{"x", "hey"})
+	_, err = c1.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 2 on "x"`, "c1 commit")
+
+	// A snapshot transaction in the same position only checks its
+	// writes, so it commits.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", []string{"snapshot"})
+
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", []string{"serializable"})
+
+	_, err = c4.execCommand("get", []string{"a"})
+	assertEq(err.Error(), "key not found", "c4 get a")
+	c4.mustExecCommand("set", []string{"b", "hey"})
+	c4.mustExecCommand("commit", nil)
+
+	_, err = c3.execCommand("get", []string{"b"})
+	assertEq(err.Error(), "key not found", "c3 get b")
+	c3.mustExecCommand("set", []string{"a", "yall"})
 	c3.mustExecCommand("commit", nil)
 }
+
+func TestScan(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	for _, key := range []string{"b", "a/2", "c", "a/1", "a"} {
+		c1.mustExecCommand("set", []string{key, key + "!"})
+	}
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("delete", []string{"a/1"})
+	c3.mustExecCommand("set", []string{"a/3", "a/3!"})
+
+	// Results are in key order, and the end is exclusive.
+	res := c2.mustExecCommand("scan", []string{"a", "c"})
+	assertEq(res, "a=a! a/1=a/1! a/2=a/2! b=b!", "c2 scan a c")
+
+	// An empty end has no upper bound.
+	res = c2.mustExecCommand("scan", []string{"b", ""})
+	assertEq(res, "b=b! c=c!", "c2 scan b")
+
+	res = c2.mustExecCommand("prefix", []string{"a/"})
+	assertEq(res, "a/1=a/1! a/2=a/2!", "c2 prefix a/")
+
+	res = c2.mustExecCommand("prefix", []string{"d"})
+	assertEq(res, "", "c2 prefix d")
+
+	// Own writes and deletes are visible.
+	res = c3.mustExecCommand("prefix", []string{"a/"})
+	assertEq(res, "a/2=a/2! a/3=a/3!", "c3 prefix a/")
+
+	c3.mustExecCommand("commit", nil)
+
+	// But not in an existing snapshot.
+	res = c2.mustExecCommand("prefix", []string{"a/"})
+	assertEq(res, "a/1=a/1! a/2=a/2!", "c2 prefix a/")
+}
+
+func TestPrefixRange(t *testing.T) {
+	assertEq(prefixRange("a/"), keyRange{"a/", "a0"}, "prefix a/")
+	assertEq(prefixRange("a\xff"), keyRange{"a\xff", "b"}, "prefix a\\xff")
+	assertEq(prefixRange("\xff\xff"), keyRange{"\xff\xff", ""}, "prefix \\xff\\xff")
+	assertEq(prefixRange(""), keyRange{"", ""}, "empty prefix")
+}
+
+func TestSerializableIsolation_phantom(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	// No more than two shifts may be booked.
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"shift/1", "alice"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	// Both see one booked shift and book another one, under keys
+	// neither of them has read.
+	res := c1.mustExecCommand("prefix", []string{"shift/"})
+	assertEq(res, "shift/1=alice", "c1 prefix shift/")
+	c1.mustExecCommand("set", []string{"shift/2", "bob"})
+
+	res = c2.mustExecCommand("scan", []string{"shift/", "shift0"})
+	assertEq(res, "shift/1=alice", "c2 scan shift/ shift0")
+	c2.mustExecCommand("set", []string{"shift/3", "carol"})
+
+	c1.mustExecCommand("commit", nil)
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 2 on "shift/3"`, "c2 commit")
+
+	// Inserts outside of the scanned ranges are not a conflict.
+	res = c3.mustExecCommand("prefix", []string{"shift/"})
+	assertEq(res, "shift/1=alice", "c3 prefix shift/")
+	c3.mustExecCommand("set", []string{"shifts", "3"})
+	c3.mustExecCommand("commit", nil)
+}
+
+func TestIncr(t *testing.T) {
+	database := newDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	// Missing keys start at 0.
+	res := c1.mustExecCommand("incr", []string{"x", "5"})
+	assertEq(res, "5", "c1 incr x")
+	res = c1.mustExecCommand("incr", []string{"x", "-7"})
+	assertEq(res, "-2", "c1 incr x")
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "-2", "c1 get x")
+
+	_, err := c1.execCommand("incr", []string{"x", "one"})
+	assertEq(err.Error(), `not an integer: "one"`, "c1 incr x one")
+	c1.mustExecCommand("set", []string{"y", "one"})
+	_, err = c1.execCommand("incr", []string{"y", "1"})
+	assertEq(err.Error(), "value is not an integer", "c1 incr y")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestCompareAndSet(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("setnx", []string{"x", "1"})
+	assertEq(res, "1", "c1 setnx x")
+	res = c1.mustExecCommand("setnx", []string{"x", "2"})
+	assertEq(res, "0", "c1 setnx x again")
+
+	res = c1.mustExecCommand("cas", []string{"x", "2", "3"})
+	assertEq(res, "0", "c1 cas x 2 3")
+	res = c1.mustExecCommand("cas", []string{"y", "", "3"})
+	assertEq(res, "0", "c1 cas y")
+	res = c1.mustExecCommand("cas", []string{"x", "1", "3"})
+	assertEq(res, "1", "c1 cas x 1 3")
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	// Evaluated against the snapshot, so both would succeed, but
+	// the second to write x conflicts with the first.
+	res = c2.mustExecCommand("cas", []string{"x", "3", "4"})
+	assertEq(res, "1", "c2 cas x")
+	_, err := c3.execCommand("cas", []string{"x", "3", "5"})
+	assertEq(err.Error(), `write-write conflict with transaction 2 on "x"`, "c3 cas x")
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestSerializableIsolation_setnx(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	// Each only creates its key if the other's is missing, so they
+	// can't both commit.
+	res := c1.mustExecCommand("setnx", []string{"y", "1"})
+	assertEq(res, "1", "c1 setnx y")
+	res = c2.mustExecCommand("setnx", []string{"x", "1"})
+	assertEq(res, "1", "c2 setnx x")
+	_, err := c1.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c1 get x")
+	_, err = c2.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c2 get y")
+
+	c1.mustExecCommand("commit", nil)
+	_, err = c2.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 1 on "x"`, "c2 commit")
+}
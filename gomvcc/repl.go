@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+const replHelp = `Every line runs a command on a named connection, which is opened on
+first use:
+
+  c1> begin snapshot
+  c2> begin snapshot
+  c1> set x 1
+  c2> get x
+
+and these commands show what is going on:
+
+  c1> show        the connection's transaction, its snapshot, and
+                  its read and write sets
+  show            the same for every connection
+  chain <key>     every version of key, and which connections see it
+  show transactions
+                  every transaction the database keeps track of
+  stats           transaction counts, aborts by reason, the oldest
+                  live snapshot, and the versions kept for each key
+  help
+  quit`
+
+// An interactive session with several named connections to the same
+// Database, for stepping through interleaved transactions by hand.
+type repl struct {
+	db          *Database
+	out         io.Writer
+	connections map[string]*Connection
+}
+
+func runREPL(db *Database, in io.Reader, out io.Writer, prompt bool) error {
+	r := &repl{db: db, out: out, connections: map[string]*Connection{}}
+
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(out, "> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Both "c1> begin" and "c1>begin" name the connection.
+		if name, command, ok := strings.Cut(fields[0], ">"); ok {
+			fields = slices.Insert(fields[1:], 0, name)
+			if command != "" {
+				fields = slices.Insert(fields, 1, command)
+			}
+		}
+
+		switch fields[0] {
+		case "quit":
+			return nil
+		case "help":
+			fmt.Fprintln(out, replHelp)
+		case "show":
+			if len(fields) > 1 {
+				r.print(r.db.newConnection().execCommand(fields[0], fields[1:]))
+				continue
+			}
+			for _, name := range r.names() {
+				r.show(name)
+			}
+		case "stats":
+			r.print(r.db.newConnection().execCommand(fields[0], fields[1:]))
+		case "chain":
+			if len(fields) != 2 {
+				fmt.Fprintln(out, "ERR usage: chain <key>")
+				continue
+			}
+			r.chain(fields[1])
+		default:
+			if len(fields) < 2 {
+				fmt.Fprintln(out, "ERR expected a command after the connection name, see help")
+				continue
+			}
+			r.exec(fields[0], fields[1], fields[2:])
+		}
+	}
+}
+
+func (r *repl) names() []string {
+	var names []string
+	for name := range r.connections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (r *repl) exec(name string, command string, args []string) {
+	c, ok := r.connections[name]
+	if !ok {
+		c = r.db.newConnection()
+		r.connections[name] = c
+	}
+
+	if command == "show" && len(args) == 0 {
+		r.show(name)
+		return
+	}
+
+	r.print(c.execCommand(command, args))
+}
+
+func (r *repl) print(res string, err error) {
+	switch {
+	case err != nil:
+		fmt.Fprintln(r.out, "ERR "+err.Error())
+	case res == "":
+		fmt.Fprintln(r.out, "OK")
+	default:
+		fmt.Fprintln(r.out, "OK "+res)
+	}
+}
+
+func (r *repl) show(name string) {
+	c := r.connections[name]
+	if c.tx == nil {
+		fmt.Fprintf(r.out, "%s: no transaction\n", name)
+		return
+	}
+	fmt.Fprintf(r.out, "%s: %v\n", name, c.tx)
+}
+
+func (r *repl) chain(key string) {
+	r.db.storeMu.RLock()
+	defer r.db.storeMu.RUnlock()
+
+	chain, ok := r.db.store.Get(key)
+	if !ok {
+		fmt.Fprintf(r.out, "%s: no versions\n", key)
+		return
+	}
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+
+	fmt.Fprintf(r.out, "%s:\n", key)
+	for _, v := range chain.versions {
+		states := []string{fmt.Sprintf("%d %v", v.txStartId, r.db.transactionState(v.txStartId))}
+		if v.txEndId > 0 {
+			states = append(states, fmt.Sprintf("%d %v", v.txEndId, r.db.transactionState(v.txEndId)))
+		}
+
+		var visibleTo []string
+		for _, name := range r.names() {
+			if tx := r.connections[name].tx; tx != nil && r.db.isvisible(tx, v) {
+				visibleTo = append(visibleTo, name)
+			}
+		}
+
+		if len(visibleTo) == 0 {
+			visibleTo = []string{"none"}
+		}
+
+		fmt.Fprintf(r.out, "  %v [%s] visible to %s\n", v, strings.Join(states, ", "), strings.Join(visibleTo, " "))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	database := newDatabase()
+	script := `
+c1> begin snapshot
+c2>begin snapshot
+c1 set x 1
+c2> get x
+show
+c1> commit
+c2> set x 2
+chain x
+c2> commit
+c3> begin
+c3> show
+chain y
+c3
+quit
+c3> commit
+`
+
+	var out strings.Builder
+	err := runREPL(&database, strings.NewReader(script), &out, false)
+	assertEq(err, nil, "run repl")
+
+	expected := `OK 1
+OK 2
+OK 1
+ERR key not found
+c1: transaction 1 (snapshot, in progress) inprogress=[] readset=[] writeset=[x] scanset=[]
+c2: transaction 2 (snapshot, in progress) inprogress=[1] readset=[x] writeset=[] scanset=[]
+OK
+OK 2
+x:
+  "1" created by 1 [1 committed] visible to none
+  "2" created by 2 [2 in progress] visible to c2
+ERR write-write conflict with transaction 1 on "x"
+OK 3
+c3: transaction 3 (read-committed, in progress) inprogress=[] readset=[] writeset=[] scanset=[]
+y: no versions
+ERR expected a command after the connection name, see help
+`
+	assertEq(out.String(), expected, "repl output")
+}
+
+func TestREPL_stats(t *testing.T) {
+	database := newDatabase()
+	script := `
+c1> begin
+c1> set x 1
+show transactions
+c1> show transactions
+stats
+show
+`
+
+	var out strings.Builder
+	err := runREPL(&database, strings.NewReader(script), &out, false)
+	assertEq(err, nil, "run repl")
+
+	expected := `OK 1
+OK 1
+OK 1 in progress (read-committed)
+OK 1 in progress (read-committed)
+OK active=1 committed=0 aborted=0 aborted.requested=0 aborted.write-write-conflict=0 aborted.read-write-conflict=0 aborted.lock-conflict=0 aborted.deadlock-detected=0 aborted.wal-error=0 oldest-snapshot=1 chain.x=1
+c1: transaction 1 (read-committed, in progress) inprogress=[] readset=[] writeset=[x] scanset=[]
+`
+	assertEq(out.String(), expected, "repl output")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Replication to read replicas. A replica connects to its leader's
+// server and asks for the commit log from the position it has applied
+// up to. The leader sends what every transaction committed, in the
+// order they committed, and keeps sending as more commit.
+//
+// The replica applies each transaction through a connection of its
+// own, and otherwise only runs read-only transactions. So they see the
+// leader as of a commit the replica has applied, and never anything
+// newer.
+//
+// Each transaction is sent as its set and delete records, followed by
+// a commit record whose value is the largest id the leader had
+// committed when it was sent, all framed as in the write-ahead log.
+
+// How far a replica has got.
+type replicaState struct {
+	mu sync.Mutex
+	// The number of commit log records applied.
+	position int
+	// The largest id of the leader transactions applied, and of those
+	// the leader said it committed.
+	applied         uint64
+	leaderCommitted uint64
+}
+
+// A database that only applies what a leader committed. See replicate.
+func newReplica() *Database {
+	d := newDatabase()
+	d.replica = &replicaState{}
+	return &d
+}
+
+// The largest id of the leader transactions the replica applied, and
+// how many ids it is behind the leader, as far as it knows.
+func (d *Database) replicationStatus() (applied uint64, lag uint64) {
+	d.replica.mu.Lock()
+	defer d.replica.mu.Unlock()
+	return d.replica.applied, d.replica.leaderCommitted - d.replica.applied
+}
+
+// Sends the commit log from where reader is on to w, and then what is
+// committed as it is, until writing fails or done is closed.
+func (d *Database) streamCommits(w *bufio.Writer, reader *commitReader, done <-chan struct{}) error {
+	var latest uint64
+	for {
+		records, appended := d.readCommits(reader)
+		for _, r := range records {
+			latest = max(latest, r.txId)
+		}
+		for _, r := range records {
+			for _, c := range r.changes {
+				record := walRecord{op: walSet, txId: r.txId, key: c.key, value: c.value}
+				if c.deleted {
+					record = walRecord{op: walDelete, txId: r.txId, key: c.key}
+				} else if !c.expiresAt.IsZero() {
+					record = walRecord{op: walExpiringSet, txId: r.txId, key: c.key, value: c.value, expiresAt: c.expiresAt.UnixNano()}
+				}
+				if _, err := w.Write(record.encode()); err != nil {
+					return err
+				}
+			}
+			commit := walRecord{op: walCommit, txId: r.txId, value: strconv.FormatUint(latest, 10)}
+			if _, err := w.Write(commit.encode()); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-appended:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Reads a record framed as in the write-ahead log.
+func readWalRecord(r io.Reader) (walRecord, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return walRecord{}, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, err
+	}
+	if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return walRecord{}, errCorruptRecord
+	}
+	return decodeWalRecord(payload)
+}
+
+// What a replica reads its leader's commits from.
+type replicationStream struct {
+	d *Database
+	r *bufio.Reader
+	c *Connection
+}
+
+// Asks the leader on conn for what was committed since what the replica
+// applied last.
+func (d *Database) startReplication(conn io.ReadWriter) (*replicationStream, error) {
+	d.replica.mu.Lock()
+	position := d.replica.position
+	d.replica.mu.Unlock()
+
+	if _, err := fmt.Fprintf(conn, "replicate %d\n", position); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if line != "OK\n" {
+		return nil, fmt.Errorf("leader refused to replicate: %s", strings.TrimSpace(line))
+	}
+
+	c := d.newConnection()
+	c.applier = true
+	return &replicationStream{d: d, r: r, c: c}, nil
+}
+
+// Reads the next transaction the leader committed, and applies it.
+func (s *replicationStream) applyNext() error {
+	var writes []walRecord
+	for {
+		record, err := readWalRecord(s.r)
+		if err != nil {
+			return err
+		}
+		switch record.op {
+		case walSet, walExpiringSet, walDelete:
+			writes = append(writes, record)
+		case walCommit:
+			latest, err := strconv.ParseUint(record.value, 10, 64)
+			if err != nil {
+				return errCorruptRecord
+			}
+			return s.apply(record.txId, writes, latest)
+		default:
+			return errCorruptRecord
+		}
+	}
+}
+
+func (s *replicationStream) apply(txId uint64, writes []walRecord, latest uint64) error {
+	if _, err := s.c.execCommand("begin", nil); err != nil {
+		return err
+	}
+	for _, w := range writes {
+		command, args := "set", []string{w.key, w.value}
+		if w.op == walExpiringSet {
+			args = append(args, "expires="+strconv.FormatInt(w.expiresAt, 10))
+		}
+		if w.op == walDelete {
+			command, args = "delete", []string{w.key}
+		}
+		if _, err := s.c.execCommand(command, args); err != nil {
+			s.c.execCommand("abort", nil)
+			return err
+		}
+	}
+	if _, err := s.c.execCommand("commit", nil); err != nil {
+		return err
+	}
+
+	state := s.d.replica
+	state.mu.Lock()
+	state.position++
+	state.applied = max(state.applied, txId)
+	state.leaderCommitted = max(state.leaderCommitted, latest)
+	state.mu.Unlock()
+	return nil
+}
+
+// Applies what the leader on conn commits, until the connection fails.
+func (d *Database) replicate(conn io.ReadWriter) error {
+	s, err := d.startReplication(conn)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := s.applyNext(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects a new replica to the leader over a pipe.
+func connectReplica(leader *Database) (*Database, *replicationStream, net.Conn) {
+	replica := newReplica()
+	replica.defaultIsolation = RepeatableReadIsolation
+	leaderSide, replicaSide := net.Pipe()
+	go newServer(leader).handle(leaderSide)
+	s, err := replica.startReplication(replicaSide)
+	assertEq(err, nil, "start replication")
+	return replica, s, replicaSide
+}
+
+// Waits until the replica has applied the leader transaction txId.
+func waitUntilApplied(replica *Database, txId uint64) {
+	for i := 0; i < 1000; i++ {
+		if applied, _ := replica.replicationStatus(); applied >= txId {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	panic("not applied")
+}
+
+func TestReplication(t *testing.T) {
+	leader := newDatabase()
+	// The replica connects after the commits.
+	leader.retainCommitLog(10)
+
+	c := leader.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("set", []string{"y", "1"})
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "lost"})
+	c.mustExecCommand("abort", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "2"})
+	c.mustExecCommand("delete", []string{"y"})
+	c.mustExecCommand("savepoint", []string{"a"})
+	c.mustExecCommand("set", []string{"z", "lost"})
+	c.mustExecCommand("rollback", []string{"to", "a"})
+	c.mustExecCommand("commit", nil)
+
+	replica, s, conn := connectReplica(&leader)
+	defer conn.Close()
+	applied, lag := replica.replicationStatus()
+	assertEq(applied, uint64(0), "applied before")
+	assertEq(lag, uint64(0), "lag before")
+
+	assertEq(s.applyNext(), nil, "apply 1")
+	applied, lag = replica.replicationStatus()
+	assertEq(applied, uint64(1), "applied")
+	assertEq(lag, uint64(2), "lag")
+
+	// Reads see the leader as of the last commit applied, and
+	// nothing newer while they last.
+	r1 := replica.newConnection()
+	r1.mustExecCommand("begin", nil)
+	res := r1.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 y=1", "r1 scan")
+
+	assertEq(s.applyNext(), nil, "apply 3")
+	applied, lag = replica.replicationStatus()
+	assertEq(applied, uint64(3), "applied")
+	assertEq(lag, uint64(0), "lag")
+
+	res = r1.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 y=1", "r1 scan again")
+	r2 := replica.newConnection()
+	r2.mustExecCommand("begin", nil)
+	res = r2.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=2", "r2 scan")
+
+	// Only the leader's commits write to a replica.
+	_, err := r2.execCommand("set", []string{"x", "3"})
+	assertEq(err.Error(), "transaction is read-only", "r2 set")
+
+	res = r2.mustExecCommand("stats", nil)
+	assert(strings.Contains(res, " replica.applied=3 replica.lag=0"), res)
+}
+
+func TestReplication_stream(t *testing.T) {
+	leader := newDatabase()
+	// The replica may connect after the first commits.
+	leader.retainCommitLog(100)
+	replica := newReplica()
+	leaderSide, replicaSide := net.Pipe()
+	go newServer(&leader).handle(leaderSide)
+	stopped := make(chan error)
+	go func() {
+		stopped <- replica.replicate(replicaSide)
+	}()
+
+	c := leader.newConnection()
+	for i := 0; i < 20; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("incr", []string{"n", "1"})
+		c.mustExecCommand("set", []string{"last", strconv.Itoa(i)})
+		c.mustExecCommand("commit", nil)
+	}
+	waitUntilApplied(replica, 20)
+
+	c.mustExecCommand("begin", nil)
+	want := c.mustExecCommand("scan", []string{""})
+	r := replica.newConnection()
+	r.mustExecCommand("begin", nil)
+	res := r.mustExecCommand("scan", []string{""})
+	assertEq(res, want, "replica scan")
+
+	replicaSide.Close()
+	assert(<-stopped != nil, "replicate stops")
+}
+
+// The commit log is rebuilt when the leader is reopened, with the
+// transactions committed after being prepared.
+func TestReplication_wal(t *testing.T) {
+	dir := t.TempDir()
+	leader := mustOpenDatabase(dir)
+	c := leader.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("prepare", []string{"g2"})
+	assertEq(leader.close(), nil, "close")
+
+	leader = mustOpenDatabase(dir)
+	defer leader.close()
+	leader.retainCommitLog(10)
+	leader.newConnection().mustExecCommand("commitprepared", []string{"g2"})
+
+	replica, s, conn := connectReplica(leader)
+	defer conn.Close()
+	assertEq(s.applyNext(), nil, "apply 1")
+	assertEq(s.applyNext(), nil, "apply 2")
+	r := replica.newConnection()
+	r.mustExecCommand("begin", nil)
+	res := r.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 y=2", "replica scan")
+}
+
+func TestReplication_badPosition(t *testing.T) {
+	leader := newDatabase()
+	leader.retainCommitLog(0)
+	c0 := leader.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("commit", nil)
+	l := startServer(&leader)
+	defer l.Close()
+
+	c := dial(l)
+	defer c.conn.Close()
+	assertEq(c.send("replicate"), "ERR usage: replicate <position>", "replicate")
+	assertEq(c.send("replicate 2"), "ERR position is past the end of the commit log", "replicate 2")
+	// Nothing was kept for the commit, as nobody was reading.
+	assertEq(c.send("replicate 0"), "ERR position too old", "replicate 0")
+	assertEq(c.send("begin"), "OK 2", "begin after")
+}
+
+// The commit log only keeps what its readers are yet to read, and the
+// last records it is told to retain.
+func TestReplication_commitLogTrimmed(t *testing.T) {
+	leader := newDatabase()
+	leader.retainCommitLog(0)
+	c := leader.newConnection()
+	commit := func(n int) {
+		for i := 0; i < n; i++ {
+			c.mustExecCommand("begin", nil)
+			c.mustExecCommand("set", []string{"x", strconv.Itoa(i)})
+			c.mustExecCommand("commit", nil)
+		}
+	}
+	commit(3)
+	assertEq(len(leader.commitLog), 0, "records without readers")
+
+	r1, err := leader.newCommitReader(3)
+	assertEq(err, nil, "new reader")
+	r2, err := leader.newCommitReader(3)
+	assertEq(err, nil, "new reader")
+	commit(4)
+	records, _ := leader.readCommits(r1)
+	assertEq(len(records), 4, "r1 records")
+	assertEq(len(leader.commitLog), 4, "records r2 is yet to read")
+	leader.closeCommitReader(r2)
+	assertEq(len(leader.commitLog), 0, "records once r2 is gone")
+	commit(2)
+	records, _ = leader.readCommits(r1)
+	assertEq(len(records), 2, "r1 records")
+	leader.closeCommitReader(r1)
+
+	leader.retainCommitLog(3)
+	commit(10)
+	assert(len(leader.commitLog) >= 3 && len(leader.commitLog) <= 6, "records retained")
+	_, err = leader.newCommitReader(leader.commitLogEndLocked() - 3)
+	assertEq(err, nil, "reader of the last 3")
+	_, err = leader.newCommitReader(3)
+	assertEq(err, errPositionTooOld, "reader of dropped records")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tidwall/btree"
+)
+
+// A write made by a transaction while it has savepoints, so that it can
+// be undone by rolling back to one of them.
+type undoRecord struct {
+	key string
+	// Copies of the versions the write closed, from before it
+	// closed them.
+	closed []Value
+	// Whether the write added a version.
+	created bool
+}
+
+type savepoint struct {
+	name string
+	// Length of the transaction's undo log when the savepoint was
+	// made.
+	undo     int
+	writeset btree.Set[string]
+	// Length of its changes.
+	changes int
+}
+
+// Remembers the state of the transaction under name. A later savepoint
+// with the same name hides this one until it is released.
+func (c *Connection) savepoint(name string) error {
+	t := c.tx
+	if err := c.db.log(walRecord{op: walSavepoint, txId: t.id, key: name}); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	writeset := *t.writeset.Copy()
+	t.mu.Unlock()
+
+	t.savepoints = append(t.savepoints, savepoint{name: name, undo: len(t.undo), writeset: writeset, changes: len(t.changes)})
+	return nil
+}
+
+// The position of the latest savepoint with the name.
+func (t *Transaction) findSavepoint(name string) (int, error) {
+	for i := len(t.savepoints) - 1; i >= 0; i-- {
+		if t.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no savepoint %q", name)
+}
+
+// Undoes every write made since the savepoint, and forgets the
+// savepoints made after it. The savepoint itself is kept.
+//
+// What was read since the savepoint stays in the read set: whatever
+// the transaction writes later may still depend on it, so it must
+// still count for the conflict checks on commit.
+func (c *Connection) rollbackTo(name string) error {
+	t := c.tx
+	i, err := t.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	if err := c.db.log(walRecord{op: walRollback, txId: t.id, key: name}); err != nil {
+		return err
+	}
+
+	sp := t.savepoints[i]
+	for j := len(t.undo) - 1; j >= sp.undo; j-- {
+		c.db.undo(t, t.undo[j])
+	}
+	t.undo = t.undo[:sp.undo]
+	t.changes = t.changes[:sp.changes]
+	t.savepoints = t.savepoints[:i+1]
+
+	t.mu.Lock()
+	t.writeset = *sp.writeset.Copy()
+	t.mu.Unlock()
+	return nil
+}
+
+// Forgets the savepoint and the ones made after it, keeping what was
+// written since.
+func (c *Connection) release(name string) error {
+	t := c.tx
+	i, err := t.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	if err := c.db.log(walRecord{op: walRelease, txId: t.id, key: name}); err != nil {
+		return err
+	}
+
+	t.savepoints = t.savepoints[:i]
+	if len(t.savepoints) == 0 {
+		t.undo = nil
+	}
+	return nil
+}
+
+func (d *Database) undo(t *Transaction, u undoRecord) {
+	d.storeMu.RLock()
+	defer d.storeMu.RUnlock()
+
+	// The chain can't have been vacuumed, as it still has a version
+	// the transaction created or closed.
+	chain, ok := d.store.Get(u.key)
+	assert(ok, "undone key exists")
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	// Versions of a transaction are added in the order it wrote them,
+	// so the one the write added is its latest.
+	var created *Value
+	if u.created {
+		for i := len(chain.versions) - 1; i >= 0; i-- {
+			if chain.versions[i].txStartId == t.id {
+				created = &Value{}
+				*created = chain.versions[i]
+				chain.versions = append(chain.versions[:i], chain.versions[i+1:]...)
+				break
+			}
+		}
+	}
+	d.undoIndexes(t, u.key, u.closed, created)
+
+	// Reopen the versions the write closed, unless another
+	// transaction has closed them since.
+	for j := len(u.closed) - 1; j >= 0; j-- {
+		closed := u.closed[j]
+		for i := len(chain.versions) - 1; i >= 0; i-- {
+			v := &chain.versions[i]
+			if v.txStartId == closed.txStartId && v.value == closed.value && v.txEndId == t.id {
+				v.txEndId = closed.txEndId
+				break
+			}
+		}
+	}
+}
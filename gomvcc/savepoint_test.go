@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSavepoint_rollbackTo(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "0"})
+	c0.mustExecCommand("set", []string{"z", "0"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("savepoint", []string{"a"})
+	c1.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("set", []string{"y", "2"})
+	c1.mustExecCommand("delete", []string{"z"})
+
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+
+	// Writes before the savepoint are kept, and those after are gone.
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+	_, err := c1.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c1 get y")
+	res = c1.mustExecCommand("get", []string{"z"})
+	assertEq(res, "0", "c1 get z")
+	assertEq(versionCount(&database, "x"), 2, "versions of x")
+	assertEq(versionCount(&database, "y"), 0, "versions of y")
+
+	// The savepoint is still there.
+	c1.mustExecCommand("delete", []string{"x"})
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x again")
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	res = c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c2 get x")
+	_, err = c2.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c2 get y")
+	res = c2.mustExecCommand("get", []string{"z"})
+	assertEq(res, "0", "c2 get z")
+}
+
+func TestSavepoint_nested(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("savepoint", []string{"a"})
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("savepoint", []string{"b"})
+	c1.mustExecCommand("set", []string{"x", "2"})
+
+	c1.mustExecCommand("rollback", []string{"to", "b"})
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+
+	// Rolling back to a forgets b.
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+	_, err := c1.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c1 get x")
+	_, err = c1.execCommand("rollback", []string{"to", "b"})
+	assertEq(err.Error(), `no savepoint "b"`, "rollback to b")
+
+	// Releasing keeps what was written.
+	c1.mustExecCommand("set", []string{"x", "3"})
+	c1.mustExecCommand("release", []string{"a"})
+	_, err = c1.execCommand("rollback", []string{"to", "a"})
+	assertEq(err.Error(), `no savepoint "a"`, "rollback to a")
+	assertEq(len(c1.tx.undo), 0, "undo log")
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	res = c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "3", "c2 get x")
+
+	_, err = c2.execCommand("rollback", []string{"a"})
+	assertEq(err.Error(), "usage: rollback to <savepoint>", "rollback a")
+}
+
+func TestSavepoint_sameName(t *testing.T) {
+	database := newDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("savepoint", []string{"a"})
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("savepoint", []string{"a"})
+	c1.mustExecCommand("set", []string{"x", "2"})
+
+	// The latest savepoint hides the earlier one until released.
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+
+	c1.mustExecCommand("release", []string{"a"})
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+	_, err := c1.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c1 get x")
+}
+
+func TestSavepoint_writewrite_conflict(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"y", "1"})
+	c1.mustExecCommand("savepoint", []string{"a"})
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("rollback", []string{"to", "a"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("commit", nil)
+
+	// The write to x was undone, so it doesn't conflict.
+	c1.mustExecCommand("commit", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("savepoint", []string{"a"})
+	c3.mustExecCommand("set", []string{"y", "3"})
+	c3.mustExecCommand("rollback", []string{"to", "a"})
+
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	c4.mustExecCommand("set", []string{"x", "4"})
+	c4.mustExecCommand("commit", nil)
+
+	// But writes after rolling back still do.
+	_, err := c3.execCommand("set", []string{"x", "3"})
+	assertEq(err.Error(), `write-write conflict with transaction 4 on "x"`, "c3 set x")
+}
+
+func TestSavepoint_readwrite_conflict(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("set", []string{"y", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	// What was read before rolling back may still decide what is
+	// written after, so it still counts.
+	for _, c := range []*Connection{c1, c2} {
+		c.mustExecCommand("savepoint", []string{"a"})
+		c.mustExecCommand("get", []string{"x"})
+		c.mustExecCommand("get", []string{"y"})
+		c.mustExecCommand("rollback", []string{"to", "a"})
+	}
+	c1.mustExecCommand("set", []string{"x", "0"})
+	c2.mustExecCommand("set", []string{"y", "0"})
+
+	c1.mustExecCommand("commit", nil)
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 2 on "y"`, "c2 commit")
+}
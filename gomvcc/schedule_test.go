@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// A command run on one of the connections of a schedule.
+type scheduleStep struct {
+	conn    int
+	command string
+	args    []string
+}
+
+// Generates a schedule of random commands interleaved across
+// connections, which commits whatever is still open at the end. The
+// same seed always gives the same schedule.
+func generateSchedule(seed int64, connections, steps int) []scheduleStep {
+	r := rand.New(rand.NewSource(seed))
+	keys := []string{"x", "y", "z"}
+	open := make([]bool, connections)
+
+	var schedule []scheduleStep
+	for i := 0; i < steps; i++ {
+		conn := r.Intn(connections)
+		step := scheduleStep{conn: conn}
+		if !open[conn] {
+			step.command = "begin"
+			open[conn] = true
+		} else {
+			key := keys[r.Intn(len(keys))]
+			savepoint := []string{"a", "b"}[r.Intn(2)]
+			switch n := r.Intn(24); {
+			case n < 7:
+				step.command, step.args = "get", []string{key}
+			case n < 13:
+				// Every value is different, so reads tell which
+				// write they saw.
+				step.command, step.args = "set", []string{key, fmt.Sprintf("v%d", i)}
+			case n < 15:
+				step.command, step.args = "delete", []string{key}
+			case n < 18:
+				step.command = "commit"
+				open[conn] = false
+			case n < 20:
+				step.command = "abort"
+				open[conn] = false
+			case n < 22:
+				step.command, step.args = "savepoint", []string{savepoint}
+			case n < 23:
+				step.command, step.args = "rollback", []string{"to", savepoint}
+			default:
+				step.command, step.args = "release", []string{savepoint}
+			}
+		}
+		schedule = append(schedule, step)
+	}
+	for conn := range open {
+		if open[conn] {
+			schedule = append(schedule, scheduleStep{conn: conn, command: "commit"})
+		}
+	}
+	return schedule
+}
+
+// Runs a schedule on a new database, one step after the other. Steps
+// that make no sense for their connection, like beginning twice, are
+// skipped, so that any part of a schedule can run. Returns the database
+// and the steps that ran, in the order of its history.
+func runSchedule(level IsolationLevel, schedule []scheduleStep) (*Database, []scheduleStep) {
+	database := newRecordedDatabase(level)
+	connections := map[int]*Connection{}
+
+	var ran []scheduleStep
+	for _, step := range schedule {
+		c := connections[step.conn]
+		if c == nil {
+			c = database.newConnection()
+			connections[step.conn] = c
+		}
+		if (step.command == "begin") != (c.tx == nil) {
+			continue
+		}
+		c.execCommand(step.command, step.args)
+		ran = append(ran, step)
+	}
+	return database, ran
+}
+
+// Checks that the history of the database has none of the anomalies
+// level rules out. Returns a description of each one it has.
+func invariantViolations(database *Database, level IsolationLevel) []historyAnomaly {
+	ops := database.history.operations()
+	anomalies, err := checkHistory(ops)
+	if err != nil {
+		return []historyAnomaly{{"invalid history", err.Error()}}
+	}
+
+	var violations []historyAnomaly
+	for _, a := range anomalies {
+		for _, kind := range proscribedAnomalies[level] {
+			if a.kind == kind {
+				violations = append(violations, a)
+			}
+		}
+	}
+
+	// Only Read Uncommitted may read what hasn't been committed yet,
+	// even when it is committed later.
+	if level == ReadUncommittedIsolation {
+		return violations
+	}
+	writers := map[version]uint64{}
+	committed := map[uint64]int{}
+	for _, op := range ops {
+		if op.err != nil {
+			continue
+		}
+		switch op.command {
+		case "set":
+			writers[version{key: op.args[0], value: op.args[1]}] = op.txId
+		case "commit":
+			committed[op.txId] = op.complete
+		}
+	}
+	for _, op := range ops {
+		if op.command != "get" || op.err != nil {
+			continue
+		}
+		v := version{key: op.args[0], value: op.result}
+		writer := writers[v]
+		if writer == 0 || writer == op.txId {
+			continue
+		}
+		if commit, ok := committed[writer]; !ok || commit > op.invoke {
+			violations = append(violations, historyAnomaly{"dirty read", fmt.Sprintf("%d read %s written by %d before it committed", op.txId, v, writer)})
+		}
+	}
+	return violations
+}
+
+// The violations of the level's invariants in the database's history,
+// one per line.
+func checkInvariants(database *Database, level IsolationLevel) string {
+	var lines []string
+	for _, v := range invariantViolations(database, level) {
+		lines = append(lines, v.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Removes as many steps from a failing schedule as it can while it
+// still fails, and then the steps that wouldn't run.
+func shrinkSchedule(level IsolationLevel, schedule []scheduleStep, fails func(*Database) bool) []scheduleStep {
+	stillFails := func(schedule []scheduleStep) bool {
+		database, _ := runSchedule(level, schedule)
+		return fails(database)
+	}
+
+	for n := len(schedule) / 2; n > 0; {
+		removed := false
+		for i := 0; i+n <= len(schedule); {
+			candidate := append(append([]scheduleStep{}, schedule[:i]...), schedule[i+n:]...)
+			if stillFails(candidate) {
+				schedule = candidate
+				removed = true
+			} else {
+				i += n
+			}
+		}
+		if !removed {
+			n /= 2
+		}
+	}
+
+	_, ran := runSchedule(level, schedule)
+	return ran
+}
+
+var isolationLevelIdentifiers = map[IsolationLevel]string{
+	ReadUncommittedIsolation: "ReadUncommittedIsolation",
+	ReadCommittedIsolation:   "ReadCommittedIsolation",
+	RepeatableReadIsolation:  "RepeatableReadIsolation",
+	SnapshotIsolation:        "SnapshotIsolation",
+	SerializableIsolation:    "SerializableIsolation",
+}
+
+// Prints a schedule run at one level and checked against another as a
+// Go test, which fails for as long as the violations do.
+func formatScheduleTest(name string, level, checked IsolationLevel, schedule []scheduleStep) string {
+	database, ran := runSchedule(level, schedule)
+	ops := database.history.operations()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "func %s(t *testing.T) {\n", name)
+	fmt.Fprintf(&b, "\tdatabase := newDatabase()\n")
+	fmt.Fprintf(&b, "\tdatabase.defaultIsolation = %s\n", isolationLevelIdentifiers[level])
+	fmt.Fprintf(&b, "\tdatabase.history = newHistory()\n\n")
+
+	// Connections are named in the order they first run a command.
+	names := map[int]string{}
+	for _, step := range ran {
+		if _, ok := names[step.conn]; !ok {
+			names[step.conn] = fmt.Sprintf("c%d", len(names)+1)
+			fmt.Fprintf(&b, "\t%s := database.newConnection()\n", names[step.conn])
+		}
+	}
+	b.WriteString("\n")
+
+	declaredRes, declaredErr := false, false
+	for i, step := range ran {
+		c := names[step.conn]
+		op := ops[i]
+		args := "nil"
+		if len(step.args) > 0 {
+			args = fmt.Sprintf("%#v", step.args)
+		}
+		message := strings.Join(append([]string{c, step.command}, step.args...), " ")
+
+		switch {
+		case op.err != nil:
+			assign := "="
+			if !declaredErr {
+				assign, declaredErr = ":=", true
+			}
+			fmt.Fprintf(&b, "\t_, err %s %s.execCommand(%q, %s)\n", assign, c, step.command, args)
+			fmt.Fprintf(&b, "\tassertEq(err.Error(), %q, %q)\n", op.err.Error(), message)
+		case step.command == "get":
+			assign := "="
+			if !declaredRes {
+				assign, declaredRes = ":=", true
+			}
+			fmt.Fprintf(&b, "\tres %s %s.mustExecCommand(%q, %s)\n", assign, c, step.command, args)
+			fmt.Fprintf(&b, "\tassertEq(res, %q, %q)\n", op.result, message)
+		default:
+			fmt.Fprintf(&b, "\t%s.mustExecCommand(%q, %s)\n", c, step.command, args)
+		}
+	}
+
+	b.WriteString("\n")
+	for _, v := range invariantViolations(database, checked) {
+		fmt.Fprintf(&b, "\t// %s\n", v)
+	}
+	fmt.Fprintf(&b, "\tassertEq(checkInvariants(&database, %s), \"\", \"invariants\")\n", isolationLevelIdentifiers[checked])
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Runs the schedule for seed at every level, and panics with a shrunk
+// test for the first violation.
+func fuzzSchedule(seed int64) {
+	schedule := generateSchedule(seed, 3, 30)
+	for _, level := range allIsolationLevels {
+		database, _ := runSchedule(level, schedule)
+		violations := invariantViolations(database, level)
+		if len(violations) == 0 {
+			continue
+		}
+
+		kind := violations[0].kind
+		shrunk := shrinkSchedule(level, schedule, func(database *Database) bool {
+			for _, v := range invariantViolations(database, level) {
+				if v.kind == kind {
+					return true
+				}
+			}
+			return false
+		})
+		name := fmt.Sprintf("TestSchedule_seed%d", seed)
+		panic(fmt.Sprintf("%s violates %s:\n\n%s", name, level, formatScheduleTest(name, level, level, shrunk)))
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	for seed := int64(0); seed < 300; seed++ {
+		fuzzSchedule(seed)
+	}
+}
+
+func FuzzSchedules(f *testing.F) {
+	f.Add(int64(0))
+	f.Fuzz(func(t *testing.T, seed int64) {
+		fuzzSchedule(seed)
+	})
+}
+
+// Two transactions read x and then both write it, which loses an update
+// at Repeatable Read, and must be caught for Snapshot Isolation.
+func TestSchedule_lostUpdate(t *testing.T) {
+	schedule := []scheduleStep{
+		{0, "begin", nil},
+		{0, "set", []string{"x", "x0"}},
+		{0, "commit", nil},
+		{1, "begin", nil},
+		{2, "begin", nil},
+		{1, "get", []string{"x"}},
+		{2, "get", []string{"x"}},
+		{1, "set", []string{"x", "x1"}},
+		{2, "set", []string{"x", "x2"}},
+		{1, "commit", nil},
+		{2, "commit", nil},
+	}
+	database, _ := runSchedule(RepeatableReadIsolation, schedule)
+	assertEq(checkInvariants(database, RepeatableReadIsolation), "", "repeatable read invariants")
+	assertEq(checkInvariants(database, SnapshotIsolation), strings.Join([]string{
+		`lost update: 2 and 3 both read x="x0" and wrote x`,
+		"G-single: 3 -rw-> 2 -ww-> 3",
+	}, "\n"), "snapshot invariants")
+
+	database, _ = runSchedule(SnapshotIsolation, schedule)
+	assertEq(checkInvariants(database, SnapshotIsolation), "", "snapshot invariants at snapshot")
+}
+
+func TestShrinkSchedule(t *testing.T) {
+	// Read Uncommitted doesn't keep the invariants of Read Committed.
+	violated := func(database *Database) bool {
+		return checkInvariants(database, ReadCommittedIsolation) != ""
+	}
+	schedule := generateSchedule(0, 3, 30)
+	database, _ := runSchedule(ReadUncommittedIsolation, schedule)
+	assert(violated(database), "violates read committed")
+
+	shrunk := shrinkSchedule(ReadUncommittedIsolation, schedule, violated)
+	assertEq(formatScheduleTest("TestSchedule_shrunk", ReadUncommittedIsolation, ReadCommittedIsolation, shrunk), `func TestSchedule_shrunk(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = ReadUncommittedIsolation
+	database.history = newHistory()
+
+	c1 := database.newConnection()
+	c2 := database.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"y", "v1"})
+	c2.mustExecCommand("begin", nil)
+	res := c2.mustExecCommand("get", []string{"y"})
+	assertEq(res, "v1", "c2 get y")
+
+	// dirty read: 2 read y="v1" written by 1 before it committed
+	assertEq(checkInvariants(&database, ReadCommittedIsolation), "", "invariants")
+}
+`, "shrunk test")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Serves the line-based protocol. Each line is a command followed by
+// its arguments, separated by whitespace:
+//
+//	begin [level]
+//	get <key>
+//	set <key> <value>
+//	commit
+//
+// and is answered with a single line, either "OK", "OK <result>" or
+// "ERR <message>". A replica instead sends
+//
+//	replicate <position>
+//
+// and after "OK" is sent the commit log from there on. See
+// replication.go. A subscriber sends
+//
+//	subscribe [prefix] [from=<txid>]
+//
+// and after "OK" is sent what committed transactions write. See cdc.go.
+type server struct {
+	db *Database
+}
+
+func newServer(db *Database) *server {
+	return &server{db: db}
+}
+
+func (s *server) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Each client gets its own Connection, and its transaction is aborted
+// if the client goes away in the middle of it.
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	c := s.db.newConnection()
+	defer func() {
+		if c.tx != nil {
+			c.execCommand("abort", nil)
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "replicate" {
+			if s.replicate(scanner, w, fields[1:]) {
+				return
+			}
+			continue
+		}
+		if fields[0] == "subscribe" {
+			if s.subscribe(scanner, w, fields[1:]) {
+				return
+			}
+			continue
+		}
+
+		if fields[0] == "quit" {
+			w.WriteString("OK\n")
+			w.Flush()
+			return
+		}
+
+		res, err := c.execCommand(fields[0], fields[1:])
+		switch {
+		case err != nil:
+			w.WriteString("ERR " + err.Error() + "\n")
+		case res == "":
+			w.WriteString("OK\n")
+		default:
+			w.WriteString("OK " + res + "\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Streams the commit log to a replica until it goes away. Returns
+// false if it couldn't, having told the replica why.
+func (s *server) replicate(scanner *bufio.Scanner, w *bufio.Writer, args []string) bool {
+	position := -1
+	if len(args) == 1 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			position = n
+		}
+	}
+	if position < 0 {
+		w.WriteString("ERR usage: replicate <position>\n")
+		return w.Flush() != nil
+	}
+	reader, err := s.db.newCommitReader(position)
+	if err != nil {
+		w.WriteString("ERR " + err.Error() + "\n")
+		return w.Flush() != nil
+	}
+	defer s.db.closeCommitReader(reader)
+	w.WriteString("OK\n")
+	s.db.streamCommits(w, reader, untilGone(scanner))
+	return true
+}
+
+// Streams what committed transactions write to a subscriber until it
+// goes away. Returns false if it couldn't, having told the subscriber
+// why.
+func (s *server) subscribe(scanner *bufio.Scanner, w *bufio.Writer, args []string) bool {
+	prefix, reader, err := s.db.subscribe(args)
+	if err != nil {
+		w.WriteString("ERR " + err.Error() + "\n")
+		return w.Flush() != nil
+	}
+	defer s.db.closeCommitReader(reader)
+	w.WriteString("OK\n")
+	s.db.streamChanges(w, prefix, reader, untilGone(scanner))
+	return true
+}
+
+// Closed when the client goes away. It sends nothing more once it is
+// being streamed to, so reading only ends then.
+func untilGone(scanner *bufio.Scanner) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for scanner.Scan() {
+		}
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startServer(db *Database) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assertEq(err, nil, "listen")
+	go newServer(db).serve(l)
+	return l
+}
+
+func dial(l net.Listener) *client {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assertEq(err, nil, "dial")
+	return &client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(line string) string {
+	_, err := fmt.Fprintln(c.conn, line)
+	assertEq(err, nil, "send "+line)
+	reply, err := c.r.ReadString('\n')
+	assertEq(err, nil, "reply to "+line)
+	return reply[:len(reply)-1]
+}
+
+func TestServer(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+	l := startServer(&database)
+	defer l.Close()
+
+	c1 := dial(l)
+	defer c1.conn.Close()
+	c2 := dial(l)
+	defer c2.conn.Close()
+
+	assertEq(c1.send("begin"), "OK 1", "c1 begin")
+	assertEq(c2.send("begin repeatable-read"), "OK 2", "c2 begin")
+
+	assertEq(c1.send("set x hey"), "OK hey", "c1 set x")
+	assertEq(c1.send("  get   x "), "OK hey", "c1 get x")
+	assertEq(c2.send("get x"), "ERR key not found", "c2 get x")
+	assertEq(c2.send("set x yall"), "OK yall", "c2 set x")
+
+	assertEq(c1.send("commit"), "OK", "c1 commit")
+	assertEq(c2.send("commit"), "OK", "c2 commit")
+
+	assertEq(c1.send("begin"), "OK 3", "c1 begin")
+	assertEq(c1.send("scan a"), "OK x=yall", "c1 scan a")
+	assertEq(c1.send("nope"), "ERR unimplemented", "c1 nope")
+	assertEq(c1.send("begin"), "ERR transaction already in progress", "c1 begin again")
+	assertEq(c1.send("get"), "ERR usage: get <key>", "c1 get")
+	assertEq(c1.send("abort"), "OK", "c1 abort")
+	assertEq(c1.send("get x"), "ERR no transaction in progress", "c1 get x")
+
+	assertEq(c1.send("quit"), "OK", "c1 quit")
+	_, err := c1.r.ReadString('\n')
+	assert(err != nil, "c1 closed")
+}
+
+func TestServer_disconnectAborts(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+	l := startServer(&database)
+	defer l.Close()
+
+	c1 := dial(l)
+	assertEq(c1.send("begin"), "OK 1", "c1 begin")
+	assertEq(c1.send("set x hey"), "OK hey", "c1 set x")
+	c1.conn.Close()
+
+	// A write-write conflict with c1 would abort c2, unless c1 was
+	// aborted.
+	c2 := dial(l)
+	defer c2.conn.Close()
+	assertEq(c2.send("begin"), "OK 2", "c2 begin")
+	assertEq(c2.send("set x yall"), "OK yall", "c2 set x")
+	assertEq(c2.send("commit"), "OK", "c2 commit")
+
+	assertEq(c2.send("begin"), "OK 3", "c2 begin")
+	assertEq(c2.send("get x"), "OK yall", "c2 get x")
+}
+
+func TestServer_concurrentClients(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = ReadCommittedIsolation
+	l := startServer(&database)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dial(l)
+			defer c.conn.Close()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("k%d", i)
+				assertEq(c.send("begin")[:2], "OK", "begin")
+				assertEq(c.send("set "+key+" "+fmt.Sprint(j)), "OK "+fmt.Sprint(j), "set")
+				assertEq(c.send("commit"), "OK", "commit")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c := dial(l)
+	defer c.conn.Close()
+	assertEq(c.send("begin")[:2], "OK", "begin")
+	assertEq(c.send("prefix k"), "OK k0=49 k1=49 k2=49 k3=49 k4=49 k5=49 k6=49 k7=49", "prefix k")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Splits keys across several databases, its shards, by their hash, and
+// commits transactions that span more than one with two-phase commit.
+//
+// The coordinator decides whether a transaction commits once every
+// shard it ran on has prepared it, and logs the decision before telling
+// the shards. If it stops between the two phases, the transaction stays
+// prepared on the shards until a new coordinator over them recovers it:
+// it commits the transactions the log says to, and aborts the rest.
+type coordinator struct {
+	shards []*Database
+
+	// Guards everything below.
+	mu sync.Mutex
+	// Set when the coordinator was opened with a directory, to keep
+	// decisions across restarts.
+	log *wal
+	// The global ids of the transactions decided to commit.
+	decided map[string]bool
+	nextGid uint64
+
+	// Called between the two phases, at "prepared" and "decided".
+	// If it returns an error, the coordinator stops there as if it
+	// had crashed. For tests.
+	failpoint func(point string) error
+}
+
+// Global ids made by the coordinator start with this, so recovery
+// leaves other prepared transactions alone.
+const gidPrefix = "shard-tx-"
+
+// Opens a coordinator over the shards, logging decisions in dir unless
+// it is empty, and recovers the transactions a previous one left
+// prepared. No other coordinator must be running over the shards.
+func newCoordinator(shards []*Database, dir string) (*coordinator, error) {
+	co := &coordinator{shards: shards, decided: map[string]bool{}, nextGid: 1}
+	if dir != "" {
+		w, records, err := openWAL(dir)
+		if err != nil {
+			return nil, err
+		}
+		co.log = w
+		for _, r := range records {
+			co.decided[r.key] = true
+			co.skipGid(r.key)
+		}
+	}
+	if err := co.recover(); err != nil {
+		co.close()
+		return nil, err
+	}
+	return co, nil
+}
+
+func (co *coordinator) close() error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if co.log == nil {
+		return nil
+	}
+	err := co.log.close()
+	co.log = nil
+	return err
+}
+
+// The shard the key is kept on.
+func (co *coordinator) shardFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(co.shards)))
+}
+
+// Makes sure gid, if the coordinator made it, isn't made again. The
+// caller must hold mu, or be opening the coordinator.
+func (co *coordinator) skipGid(gid string) {
+	n, ok := strings.CutPrefix(gid, gidPrefix)
+	if !ok {
+		return
+	}
+	if id, err := strconv.ParseUint(n, 10, 64); err == nil && id >= co.nextGid {
+		co.nextGid = id + 1
+	}
+}
+
+func (co *coordinator) newGid() string {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	gid := fmt.Sprintf("%s%d", gidPrefix, co.nextGid)
+	co.nextGid++
+	return gid
+}
+
+// Durably decides to commit the transaction prepared as gid.
+func (co *coordinator) decide(gid string) error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if co.log != nil {
+		if err := co.log.append(walRecord{op: walCommit, key: gid}); err != nil {
+			return err
+		}
+		if err := co.log.sync(); err != nil {
+			return err
+		}
+	}
+	co.decided[gid] = true
+	return nil
+}
+
+func (co *coordinator) crashAt(point string) error {
+	if co.failpoint == nil {
+		return nil
+	}
+	return co.failpoint(point)
+}
+
+// Completes the transactions that a coordinator left prepared on the
+// shards: those it decided to commit are committed, and the rest,
+// which it can't have committed anywhere, are aborted.
+func (co *coordinator) recover() error {
+	for _, shard := range co.shards {
+		for _, gid := range shard.preparedIds() {
+			if !strings.HasPrefix(gid, gidPrefix) {
+				continue
+			}
+			co.mu.Lock()
+			co.skipGid(gid)
+			state := AbortedTransaction
+			if co.decided[gid] {
+				state = CommittedTransaction
+			}
+			co.mu.Unlock()
+
+			debug("recovering", gid, state)
+			if err := shard.completePrepared(gid, state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Commits a transaction that ran on each of the connections, which are
+// to different shards. If it can't be prepared on one of them, it is
+// aborted on all of them.
+func (co *coordinator) commit(participants []*Connection) error {
+	gid := co.newGid()
+
+	for i, c := range participants {
+		if _, err := c.execCommand("prepare", []string{gid}); err != nil {
+			for _, p := range participants[:i] {
+				p.db.newConnection().execCommand("abortprepared", []string{gid})
+			}
+			for _, p := range participants[i+1:] {
+				p.execCommand("abort", nil)
+			}
+			return err
+		}
+	}
+	if err := co.crashAt("prepared"); err != nil {
+		return err
+	}
+
+	if err := co.decide(gid); err != nil {
+		for _, p := range participants {
+			p.db.newConnection().execCommand("abortprepared", []string{gid})
+		}
+		return err
+	}
+	if err := co.crashAt("decided"); err != nil {
+		return err
+	}
+
+	// The transaction is committed now, whatever happens to the
+	// shards, so every one of them is told.
+	var firstErr error
+	for _, p := range participants {
+		if _, err := p.db.newConnection().execCommand("commitprepared", []string{gid}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// A connection to every shard of a coordinator, used like a Connection
+// to a single database. A transaction begins on every shard at once,
+// so it can't see the same snapshot on all of them, only one on each.
+type shardedConnection struct {
+	co    *coordinator
+	conns []*Connection
+	// The shards the transaction in progress has used.
+	touched []bool
+}
+
+func (co *coordinator) newConnection() *shardedConnection {
+	c := &shardedConnection{co: co}
+	for _, shard := range co.shards {
+		c.conns = append(c.conns, shard.newConnection())
+	}
+	return c
+}
+
+func (c *shardedConnection) inTransaction() bool {
+	return c.touched != nil
+}
+
+func (c *shardedConnection) execCommand(command string, args []string) (string, error) {
+	debug("sharded", command, args)
+
+	switch command {
+	case "begin":
+		if c.inTransaction() {
+			return "", ErrTransactionInProgress
+		}
+		for _, conn := range c.conns {
+			if _, err := conn.execCommand(command, args); err != nil {
+				c.abort()
+				return "", err
+			}
+		}
+		c.touched = make([]bool, len(c.conns))
+		return "", nil
+	case "abort":
+		if !c.inTransaction() {
+			return "", ErrNoTransaction
+		}
+		c.abort()
+		return "", nil
+	case "commit":
+		if !c.inTransaction() {
+			return "", ErrNoTransaction
+		}
+		return "", c.commit()
+	case "get", "set", "delete", "incr", "cas", "setnx":
+		if len(args) == 0 {
+			return c.conns[0].execCommand(command, args)
+		}
+		i := c.co.shardFor(args[0])
+		res, err := c.conns[i].execCommand(command, args)
+		c.used(i)
+		return res, err
+	case "scan", "prefix":
+		// Each shard has its keys in order, but only its own.
+		var res []string
+		for i, conn := range c.conns {
+			r, err := conn.execCommand(command, args)
+			c.used(i)
+			if err != nil {
+				return "", err
+			}
+			if r != "" {
+				res = append(res, strings.Split(r, " ")...)
+			}
+		}
+		slices.SortFunc(res, func(a, b string) int {
+			ka, _, _ := strings.Cut(a, "=")
+			kb, _, _ := strings.Cut(b, "=")
+			return strings.Compare(ka, kb)
+		})
+		return strings.Join(res, " "), nil
+	}
+	if _, ok := commands[command]; ok {
+		return "", fmt.Errorf("%s is not supported across shards", command)
+	}
+	return "", fmt.Errorf("unimplemented")
+}
+
+func (c *shardedConnection) mustExecCommand(cmd string, args []string) string {
+	res, err := c.execCommand(cmd, args)
+	assertEq(err, nil, "unexpected error")
+	return res
+}
+
+// Marks the shard as used by the transaction. If the shard's part of it
+// was aborted, by a conflict say, so is the rest.
+func (c *shardedConnection) used(i int) {
+	if !c.inTransaction() {
+		return
+	}
+	c.touched[i] = true
+	if c.conns[i].tx == nil {
+		c.abort()
+	}
+}
+
+func (c *shardedConnection) abort() {
+	for _, conn := range c.conns {
+		if conn.tx != nil {
+			conn.execCommand("abort", nil)
+		}
+	}
+	c.touched = nil
+}
+
+// Commits the transaction on the shards it used, with two-phase commit
+// if there are several. It did nothing on the others, so it is aborted
+// there.
+func (c *shardedConnection) commit() error {
+	var participants []*Connection
+	for i, conn := range c.conns {
+		if c.touched[i] {
+			participants = append(participants, conn)
+		} else {
+			conn.execCommand("abort", nil)
+		}
+	}
+	c.touched = nil
+
+	switch len(participants) {
+	case 0:
+		return nil
+	case 1:
+		_, err := participants[0].execCommand("commit", nil)
+		return err
+	}
+	return c.co.commit(participants)
+}
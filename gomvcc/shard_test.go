@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var errCrash = errors.New("coordinator crashed")
+
+func newShards(n int) []*Database {
+	var shards []*Database
+	for i := 0; i < n; i++ {
+		database := newDatabase()
+		database.defaultIsolation = SnapshotIsolation
+		shards = append(shards, &database)
+	}
+	return shards
+}
+
+func mustNewCoordinator(shards []*Database, dir string) *coordinator {
+	co, err := newCoordinator(shards, dir)
+	assertEq(err, nil, "new coordinator")
+	return co
+}
+
+// A key for each shard.
+func shardKeys(co *coordinator) []string {
+	keys := make([]string, len(co.shards))
+	for i, found := 0, 0; found < len(keys); i++ {
+		key := fmt.Sprintf("k%d", i)
+		if shard := co.shardFor(key); keys[shard] == "" {
+			keys[shard] = key
+			found++
+		}
+	}
+	return keys
+}
+
+// The value of key, read from its shard directly.
+func shardGet(co *coordinator, key string) string {
+	c := co.shards[co.shardFor(key)].newConnection()
+	c.mustExecCommand("begin", nil)
+	defer c.mustExecCommand("abort", nil)
+	res, err := c.execCommand("get", []string{key})
+	if err != nil {
+		return err.Error()
+	}
+	return res
+}
+
+func TestCoordinator(t *testing.T) {
+	co := mustNewCoordinator(newShards(3), "")
+	keys := shardKeys(co)
+
+	c1 := co.newConnection()
+	c1.mustExecCommand("begin", nil)
+	for i, key := range keys {
+		c1.mustExecCommand("set", []string{key, fmt.Sprint(i)})
+	}
+	res := c1.mustExecCommand("get", []string{keys[1]})
+	assertEq(res, "1", "c1 get")
+	c1.mustExecCommand("commit", nil)
+
+	// Each key is only kept on its shard.
+	for i, key := range keys {
+		for j, shard := range co.shards {
+			c := shard.newConnection()
+			c.mustExecCommand("begin", nil)
+			_, err := c.execCommand("get", []string{key})
+			assertEq(err == nil, i == j, fmt.Sprintf("%s on shard %d", key, j))
+		}
+	}
+
+	// Scans see every shard, in key order.
+	c2 := co.newConnection()
+	c2.mustExecCommand("begin", nil)
+	res = c2.mustExecCommand("scan", []string{""})
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	var pairs []string
+	for _, key := range sorted {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", key, slices.Index(keys, key)))
+	}
+	assertEq(res, strings.Join(pairs, " "), "c2 scan")
+	c2.mustExecCommand("set", []string{keys[0], "3"})
+	c2.mustExecCommand("commit", nil)
+	assertEq(shardGet(co, keys[0]), "3", "get after single shard commit")
+
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err, ErrNoTransaction, "commit without begin")
+	c2.mustExecCommand("begin", nil)
+	_, err = c2.execCommand("begin", nil)
+	assertEq(err, ErrTransactionInProgress, "begin twice")
+	_, err = c2.execCommand("createindex", []string{"color"})
+	assertEq(err.Error(), "createindex is not supported across shards", "createindex")
+}
+
+// A transaction that fails to prepare on one shard is aborted on all.
+func TestCoordinator_prepareFails(t *testing.T) {
+	co := mustNewCoordinator(newShards(2), "")
+	keys := shardKeys(co)
+
+	c1 := co.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{keys[0], "1"})
+	c1.mustExecCommand("set", []string{keys[1], "1"})
+
+	c2 := co.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{keys[1], "2"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrConflict), "c1 commit conflicts")
+	assertEq(shardGet(co, keys[0]), "key not found", "get on the shard that prepared")
+	assertEq(shardGet(co, keys[1]), "2", "get on the shard that conflicted")
+	for _, shard := range co.shards {
+		assertEq(len(shard.preparedIds()), 0, "prepared")
+	}
+}
+
+// A conflict on one shard before commit aborts the transaction
+// everywhere.
+func TestCoordinator_abortedShard(t *testing.T) {
+	shards := newShards(2)
+	for _, shard := range shards {
+		shard.writeConflicts = FirstUpdaterWins
+	}
+	co := mustNewCoordinator(shards, "")
+	keys := shardKeys(co)
+
+	c1 := co.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := co.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{keys[0], "1"})
+	c1.mustExecCommand("set", []string{keys[1], "1"})
+	c1.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("set", []string{keys[1], "2"})
+	assert(errors.Is(err, ErrConflict), "c2 set conflicts")
+	for _, conn := range c2.conns {
+		assert(conn.tx == nil, "c2 aborted on every shard")
+	}
+	_, err = c2.execCommand("commit", nil)
+	assertEq(err, ErrNoTransaction, "c2 commit")
+}
+
+// Runs a transaction over two shards whose coordinator crashes at
+// point, and recovers it with a new coordinator.
+func crashAndRecover(shards []*Database, dir string, point string) *coordinator {
+	co := mustNewCoordinator(shards, dir)
+	keys := shardKeys(co)
+	co.failpoint = func(p string) error {
+		if p == point {
+			return errCrash
+		}
+		return nil
+	}
+
+	c := co.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{keys[0], "1"})
+	c.mustExecCommand("set", []string{keys[1], "1"})
+	_, err := c.execCommand("commit", nil)
+	assertEq(err, errCrash, "commit crashes")
+
+	// The transaction is in doubt until recovery.
+	for i, shard := range shards {
+		assertEq(len(shard.preparedIds()), 1, "prepared")
+		assertEq(shardGet(co, keys[i]), "key not found", "get before recovery")
+	}
+	assertEq(co.close(), nil, "close coordinator")
+
+	return mustNewCoordinator(shards, dir)
+}
+
+func TestCoordinator_crashBeforeDecision(t *testing.T) {
+	shards := newShards(2)
+	co := crashAndRecover(shards, t.TempDir(), "prepared")
+	defer co.close()
+
+	for _, key := range shardKeys(co) {
+		assertEq(shardGet(co, key), "key not found", "get after recovery")
+	}
+	for _, shard := range shards {
+		assertEq(len(shard.preparedIds()), 0, "prepared")
+	}
+}
+
+func TestCoordinator_crashAfterDecision(t *testing.T) {
+	shards := newShards(2)
+	co := crashAndRecover(shards, t.TempDir(), "decided")
+	defer co.close()
+
+	for _, key := range shardKeys(co) {
+		assertEq(shardGet(co, key), "1", "get after recovery")
+	}
+	for _, shard := range shards {
+		assertEq(len(shard.preparedIds()), 0, "prepared")
+	}
+
+	// Global ids aren't made again.
+	c := co.newConnection()
+	c.mustExecCommand("begin", nil)
+	for _, key := range shardKeys(co) {
+		c.mustExecCommand("set", []string{key, "2"})
+	}
+	c.mustExecCommand("commit", nil)
+}
+
+// The shards restart too, before the coordinator recovers.
+func TestCoordinator_crashWithShards(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	var shards []*Database
+	for _, dir := range dirs {
+		shards = append(shards, mustOpenDatabase(dir))
+	}
+	coordinatorDir := t.TempDir()
+
+	co := mustNewCoordinator(shards, coordinatorDir)
+	keys := shardKeys(co)
+	co.failpoint = func(p string) error {
+		if p == "decided" {
+			return errCrash
+		}
+		return nil
+	}
+	c := co.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{keys[0], "1"})
+	c.mustExecCommand("set", []string{keys[1], "1"})
+	_, err := c.execCommand("commit", nil)
+	assertEq(err, errCrash, "commit crashes")
+	assertEq(co.close(), nil, "close coordinator")
+
+	for i, dir := range dirs {
+		assertEq(shards[i].close(), nil, "close shard")
+		shards[i] = mustOpenDatabase(dir)
+		defer shards[i].close()
+	}
+	co = mustNewCoordinator(shards, coordinatorDir)
+	defer co.close()
+	for _, key := range keys {
+		assertEq(shardGet(co, key), "1", "get after recovery")
+	}
+}
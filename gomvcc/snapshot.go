@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+)
+
+// The transactions whose effects a transaction may see, as in Postgres:
+// those that started before it and weren't still in progress when it
+// did. Taking one only copies the ids of the transactions in progress,
+// however many came before.
+type snapshot struct {
+	// Every transaction below xmin had finished.
+	xmin uint64
+	// No transaction from xmax on had started.
+	xmax uint64
+	// The transactions in progress, which are all in [xmin, xmax),
+	// in order.
+	xip []uint64
+}
+
+// Whether the transaction was in progress when the snapshot was taken.
+func (s snapshot) inProgress(txId uint64) bool {
+	if txId < s.xmin || txId >= s.xmax {
+		return false
+	}
+	_, found := slices.BinarySearch(s.xip, txId)
+	return found
+}
+
+// Takes a snapshot for a transaction about to start. The caller must
+// hold txMu for writing.
+func (d *Database) takeSnapshot() snapshot {
+	s := snapshot{xmin: d.nextTransactionId, xmax: d.nextTransactionId}
+	if oldest, ok := d.active.Min(); ok {
+		s.xmin = oldest
+	}
+	if d.active.Len() > 0 {
+		s.xip = make([]uint64, 0, d.active.Len())
+		d.active.Scan(func(id uint64) bool {
+			s.xip = append(s.xip, id)
+			return true
+		})
+	}
+	return s
+}
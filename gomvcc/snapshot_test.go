@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	database := newDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c2.mustExecCommand("commit", nil)
+
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	s := c4.tx.snapshot
+	assertEq(s.xmin, uint64(1), "xmin")
+	assertEq(s.xmax, uint64(4), "xmax")
+	assertEq(fmt.Sprint(s.xip), "[1 3]", "xip")
+
+	for id, inProgress := range []bool{false, true, false, true, false, false} {
+		assertEq(s.inProgress(uint64(id)), inProgress, fmt.Sprintf("%d in progress", id))
+	}
+
+	// Once they finish, the snapshot starts at the next transaction.
+	c1.mustExecCommand("abort", nil)
+	c3.mustExecCommand("commit", nil)
+	c4.mustExecCommand("commit", nil)
+	c5 := database.newConnection()
+	c5.mustExecCommand("begin", nil)
+	s = c5.tx.snapshot
+	assertEq(s.xmin, uint64(5), "xmin")
+	assertEq(s.xmax, uint64(5), "xmax")
+	assertEq(len(s.xip), 0, "xip")
+	assertEq(database.active.Len(), 1, "active")
+}
+
+// Begins and commits a transaction after history transactions have
+// already run, while a few others are still in progress.
+func BenchmarkBegin(b *testing.B) {
+	for _, history := range []int{1_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("history=%d", history), func(b *testing.B) {
+			database := newDatabase()
+			database.defaultIsolation = SnapshotIsolation
+			for i := 0; i < history; i++ {
+				if i%(history/10) == 0 {
+					database.newConnection().mustExecCommand("begin", nil)
+					continue
+				}
+				t := database.newTransaction(SnapshotIsolation, false)
+				database.completeTransaction(t, CommittedTransaction, "")
+			}
+
+			c := database.newConnection()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.mustExecCommand("begin", nil)
+				c.mustExecCommand("commit", nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Reasons transactions are aborted for.
+const (
+	abortRequested          = "requested"
+	abortWriteWriteConflict = "write-write conflict"
+	abortReadWriteConflict  = "read-write conflict"
+	abortLockConflict       = "lock conflict"
+	abortDeadlock           = "deadlock detected"
+	abortWALError           = "wal error"
+)
+
+var abortReasons = []string{
+	abortRequested,
+	abortWriteWriteConflict,
+	abortReadWriteConflict,
+	abortLockConflict,
+	abortDeadlock,
+	abortWALError,
+}
+
+// The length of the version chain of a key.
+type chainLength struct {
+	key      string
+	versions int
+}
+
+// What the database is doing right now, and what it has done since it
+// was opened.
+type DatabaseStats struct {
+	active    int
+	committed uint64
+	// By reason, for every reason in abortReasons.
+	aborted map[string]uint64
+	// See oldestActiveSnapshot.
+	oldestSnapshot uint64
+	// In key order.
+	chains []chainLength
+	// For replicas, see replicationStatus.
+	replica bool
+	applied uint64
+	lag     uint64
+}
+
+func (d *Database) stats() DatabaseStats {
+	var stats DatabaseStats
+
+	d.txMu.RLock()
+	stats.active = d.active.Len()
+	stats.committed = d.committedCount
+	stats.aborted = map[string]uint64{}
+	for reason, n := range d.abortedCount {
+		stats.aborted[reason] = n
+	}
+	stats.oldestSnapshot = d.oldestActiveSnapshot()
+	d.txMu.RUnlock()
+
+	if d.replica != nil {
+		stats.replica = true
+		stats.applied, stats.lag = d.replicationStatus()
+	}
+
+	d.storeMu.RLock()
+	defer d.storeMu.RUnlock()
+	iter := d.store.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		chain := iter.Value()
+		chain.mu.RLock()
+		stats.chains = append(stats.chains, chainLength{iter.Key(), len(chain.versions)})
+		chain.mu.RUnlock()
+	}
+	return stats
+}
+
+func (s DatabaseStats) abortedTotal() uint64 {
+	var total uint64
+	for _, n := range s.aborted {
+		total += n
+	}
+	return total
+}
+
+// Formats the stats as a single line of name=value fields, for the
+// stats command.
+func (s DatabaseStats) String() string {
+	fields := []string{
+		fmt.Sprintf("active=%d", s.active),
+		fmt.Sprintf("committed=%d", s.committed),
+		fmt.Sprintf("aborted=%d", s.abortedTotal()),
+	}
+	for _, reason := range abortReasons {
+		fields = append(fields, fmt.Sprintf("aborted.%s=%d", strings.ReplaceAll(reason, " ", "-"), s.aborted[reason]))
+	}
+	fields = append(fields, fmt.Sprintf("oldest-snapshot=%d", s.oldestSnapshot))
+	if s.replica {
+		fields = append(fields, fmt.Sprintf("replica.applied=%d", s.applied), fmt.Sprintf("replica.lag=%d", s.lag))
+	}
+	for _, c := range s.chains {
+		fields = append(fields, fmt.Sprintf("chain.%s=%d", c.key, c.versions))
+	}
+	return strings.Join(fields, " ")
+}
+
+// Lists the transactions the database still keeps track of, for the
+// show transactions command.
+func (d *Database) showTransactions() string {
+	d.txMu.RLock()
+	defer d.txMu.RUnlock()
+
+	var entries []string
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		entry := fmt.Sprintf("%d %s", t.id, t.state)
+		if t.state == InProgressTransaction {
+			details := []string{t.isolation.String()}
+			if t.readonly {
+				details = append(details, "readonly")
+			}
+			if t.prepared() {
+				details = append(details, fmt.Sprintf("prepared %q", t.gid))
+			}
+			if len(t.snapshot.xip) > 0 {
+				details = append(details, fmt.Sprintf("snapshot from %d", t.snapshot.xip[0]))
+			}
+			entry += " (" + strings.Join(details, ", ") + ")"
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, "; ")
+}
+
+// Escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes the stats in the Prometheus text format.
+func (s DatabaseStats) writeMetrics(w io.Writer) error {
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("gomvcc_transactions_active", "gauge", "Transactions in progress.")
+	fmt.Fprintf(&b, "gomvcc_transactions_active %d\n", s.active)
+
+	metric("gomvcc_transactions_committed_total", "counter", "Transactions committed since the database was opened.")
+	fmt.Fprintf(&b, "gomvcc_transactions_committed_total %d\n", s.committed)
+
+	metric("gomvcc_transactions_aborted_total", "counter", "Transactions aborted since the database was opened, by reason.")
+	for _, reason := range abortReasons {
+		fmt.Fprintf(&b, "gomvcc_transactions_aborted_total{reason=\"%s\"} %d\n", labelEscaper.Replace(reason), s.aborted[reason])
+	}
+
+	metric("gomvcc_oldest_snapshot", "gauge", "The oldest transaction id a live transaction may still need to tell apart from the ones before it.")
+	fmt.Fprintf(&b, "gomvcc_oldest_snapshot %d\n", s.oldestSnapshot)
+
+	if s.replica {
+		metric("gomvcc_replica_lag", "gauge", "Transaction ids the replica is behind its leader.")
+		fmt.Fprintf(&b, "gomvcc_replica_lag %d\n", s.lag)
+	}
+
+	metric("gomvcc_version_chain_length", "gauge", "Versions kept for each key.")
+	for _, c := range s.chains {
+		fmt.Fprintf(&b, "gomvcc_version_chain_length{key=\"%s\"} %d\n", labelEscaper.Replace(c.key), c.versions)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Serves the database's stats in the Prometheus text format.
+func metricsHandler(d *Database) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.stats().writeMetrics(w)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A few transactions, one of each outcome, with c3 left running.
+func newStatsDatabase() *Database {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "0"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c2.execCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("commit", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", []string{"snapshot"})
+	c3.mustExecCommand("set", []string{"y", "3"})
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", []string{"readonly"})
+	c4.mustExecCommand("abort", nil)
+	return &database
+}
+
+func TestStats(t *testing.T) {
+	database := newStatsDatabase()
+
+	c := database.newConnection()
+	res := c.mustExecCommand("stats", nil)
+	assertEq(res, "active=1 committed=2 aborted=2 aborted.requested=1 aborted.write-write-conflict=1 aborted.read-write-conflict=0 aborted.lock-conflict=0 aborted.deadlock-detected=0 aborted.wal-error=0 oldest-snapshot=4 chain.x=2 chain.y=1", "stats")
+
+	res = c.mustExecCommand("show", []string{"transactions"})
+	assertEq(res, "1 committed; 2 committed; 3 aborted; 4 in progress (snapshot); 5 aborted", "show transactions")
+
+	// Vacuum forgets the transactions before the oldest snapshot, but
+	// not how many there were.
+	c.mustExecCommand("vacuum", nil)
+	res = c.mustExecCommand("show", []string{"transactions"})
+	assertEq(res, "4 in progress (snapshot); 5 aborted", "show transactions after vacuum")
+	res = c.mustExecCommand("stats", nil)
+	assert(strings.HasPrefix(res, "active=1 committed=2 aborted=2 aborted.requested=1 aborted.write-write-conflict=1 "), res)
+
+	_, err := c.execCommand("show", nil)
+	assertEq(err.Error(), "usage: show transactions", "show")
+}
+
+func TestStats_snapshot(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", []string{"readonly"})
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c1.mustExecCommand("commit", nil)
+
+	res := c1.mustExecCommand("show", []string{"transactions"})
+	assertEq(res, "1 committed; 2 in progress (repeatable-read, readonly, snapshot from 1); 3 in progress (repeatable-read, snapshot from 1)", "show transactions")
+
+	// Both still see 1 as in progress.
+	stats := database.stats()
+	assertEq(stats.active, 2, "active")
+	assertEq(stats.oldestSnapshot, uint64(1), "oldest snapshot")
+}
+
+// Transactions are listed while others begin, which the race detector
+// checks.
+func TestStats_showTransactionsConcurrently(t *testing.T) {
+	database := newDatabase()
+	runConcurrently(&database, 4, func(i int, c *Connection) {
+		for j := 0; j < 200; j++ {
+			if i%2 == 0 {
+				c.mustExecCommand("show", []string{"transactions"})
+				continue
+			}
+			c.mustExecCommand("begin", []string{"readonly"})
+			c.mustExecCommand("commit", nil)
+		}
+	})
+}
+
+func TestStats_metrics(t *testing.T) {
+	database := newStatsDatabase()
+
+	server := httptest.NewServer(metricsHandler(database))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	assertEq(err, nil, "get metrics")
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assertEq(err, nil, "read metrics")
+
+	assert(strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"), "content type")
+	for _, line := range []string{
+		"# TYPE gomvcc_transactions_active gauge",
+		"gomvcc_transactions_active 1",
+		"# TYPE gomvcc_transactions_committed_total counter",
+		"gomvcc_transactions_committed_total 2",
+		`gomvcc_transactions_aborted_total{reason="requested"} 1`,
+		`gomvcc_transactions_aborted_total{reason="write-write conflict"} 1`,
+		`gomvcc_transactions_aborted_total{reason="read-write conflict"} 0`,
+		"gomvcc_oldest_snapshot 4",
+		`gomvcc_version_chain_length{key="x"} 2`,
+		`gomvcc_version_chain_length{key="y"} 1`,
+	} {
+		assert(strings.Contains(string(body), line+"\n"), line)
+	}
+}
+
+func TestStats_labelEscaping(t *testing.T) {
+	stats := DatabaseStats{chains: []chainLength{{`a"b\c`, 2}}}
+	var b strings.Builder
+	assertEq(stats.writeMetrics(&b), nil, "write metrics")
+	assert(strings.Contains(b.String(), `gomvcc_version_chain_length{key="a\"b\\c"} 2`), b.String())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values can be given a time to expire at, with set's ttl option or
+// with expire. An expired version is gone for the transactions that
+// begin after it expired, but those that began before still see it, as
+// it was in their snapshot, and so do those reading as of a transaction
+// that committed before it expired. Once none of those are left, and
+// no retained commit is that old, vacuum removes it.
+
+// The time by the database's clock.
+func (d *Database) now() time.Time {
+	if d.clock != nil {
+		return d.clock()
+	}
+	return time.Now()
+}
+
+// When the transaction's snapshot was taken: when it began, or, when
+// it reads as of a past transaction, when that one committed.
+func (t *Transaction) snapshotTime() time.Time {
+	if t.asof > 0 {
+		return t.asofTime
+	}
+	return t.begun
+}
+
+// Whether the version had expired when the transaction's snapshot was
+// taken.
+func (t *Transaction) expired(v Value) bool {
+	return !t.ignoreExpiry && !v.expiresAt.IsZero() && !t.snapshotTime().Before(v.expiresAt)
+}
+
+// When a value written now expires, given seconds from now.
+func (d *Database) expiryIn(seconds string) (time.Time, error) {
+	s, err := strconv.ParseFloat(seconds, 64)
+	if err != nil || s < 0 {
+		return time.Time{}, badArgs("not a number of seconds: %q", seconds)
+	}
+	return d.now().Add(time.Duration(s * float64(time.Second))), nil
+}
+
+// When a value written now with set's option expires. The option is
+// either ttl=<seconds>, or expires=<unix nanoseconds>, which replicas
+// are sent.
+func (d *Database) parseExpiry(option string) (time.Time, error) {
+	if seconds, ok := strings.CutPrefix(option, "ttl="); ok {
+		return d.expiryIn(seconds)
+	}
+	if nanos, ok := strings.CutPrefix(option, "expires="); ok {
+		n, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			return time.Time{}, badArgs("not a time: %q", nanos)
+		}
+		return time.Unix(0, n), nil
+	}
+	return time.Time{}, badArgs("usage: %s", commands["set"].usage)
+}
+
+// Versions that expired before this had expired before the snapshot
+// of every live transaction was taken. The caller must hold txMu.
+func (d *Database) oldestActiveSnapshotTime() time.Time {
+	oldest := d.now()
+	iter := d.active.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t, _ := d.transactions.Get(iter.Key())
+		if t.snapshotTime().Before(oldest) {
+			oldest = t.snapshotTime()
+		}
+	}
+	return oldest
+}
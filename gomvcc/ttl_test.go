@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTTLDatabase() (*Database, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+	database.clock = clock.Now
+	return &database, clock
+}
+
+func TestTTL(t *testing.T) {
+	database, clock := newTTLDatabase()
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1", "ttl=10"})
+	c0.mustExecCommand("set", []string{"y", "2"})
+	c0.mustExecCommand("commit", nil)
+
+	clock.advance(5 * time.Second)
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	// Gone for transactions that begin after it expired, but not for
+	// those that began before.
+	clock.advance(5 * time.Second)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	_, err := c2.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c2 get x")
+	res := c2.mustExecCommand("scan", []string{""})
+	assertEq(res, "y=2", "c2 scan")
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+	res = c1.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 y=2", "c1 scan")
+
+	// To c2 the key doesn't exist anymore.
+	res = c2.mustExecCommand("setnx", []string{"x", "3"})
+	assertEq(res, "1", "c2 setnx x")
+	c2.mustExecCommand("commit", nil)
+	c1.mustExecCommand("commit", nil)
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res = c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "3", "c3 get x")
+
+	_, err = c3.execCommand("set", []string{"x", "1", "ttl=soon"})
+	assert(errors.Is(err, ErrBadArgs), "set ttl=soon")
+	assertEq(err.Error(), `not a number of seconds: "soon"`, "set ttl=soon")
+	_, err = c3.execCommand("set", []string{"x", "1", "10"})
+	assertEq(err.Error(), "usage: set <key> <value> [ttl=<seconds>]", "set 10")
+}
+
+func TestTTL_expire(t *testing.T) {
+	database, clock := newTTLDatabase()
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("set", []string{"y", "1", "ttl=10"})
+	c.mustExecCommand("set", []string{"z", "1", "ttl=10"})
+	res := c.mustExecCommand("expire", []string{"x", "10"})
+	assertEq(res, "1", "expire x")
+	res = c.mustExecCommand("expire", []string{"w", "10"})
+	assertEq(res, "0", "expire missing key")
+	res = c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "get x")
+
+	// incr keeps the expiry, and set without a ttl drops it.
+	c.mustExecCommand("incr", []string{"y", "1"})
+	c.mustExecCommand("set", []string{"z", "2"})
+	c.mustExecCommand("commit", nil)
+
+	clock.advance(10 * time.Second)
+	c.mustExecCommand("begin", nil)
+	res = c.mustExecCommand("scan", []string{""})
+	assertEq(res, "z=2", "scan after expiry")
+}
+
+func TestTTL_vacuum(t *testing.T) {
+	database, clock := newTTLDatabase()
+	database.mustExec("createindex", "value")
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1", "ttl=10"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	clock.advance(time.Minute)
+
+	// c1 can still see it.
+	database.vacuum()
+	assertEq(versionCount(database, "x"), 1, "versions while c1 runs")
+	res := c1.mustExecCommand("getby", []string{"value", "1"})
+	assertEq(res, "x", "c1 getby 1")
+	c1.mustExecCommand("commit", nil)
+
+	stats := database.vacuum()
+	assertEq(stats.versions, 1, "vacuumed versions")
+	assertEq(versionCount(database, "x"), 0, "versions after c1")
+	assertEq(entryCount(database, "value"), 0, "entries after c1")
+}
+
+// Reading as of a past transaction, values are expired or not as they
+// were when it committed.
+func TestTTL_asof(t *testing.T) {
+	database, clock := newTTLDatabase()
+	database.retainCommits = 2
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1", "ttl=10"})
+	c.mustExecCommand("commit", nil)
+	clock.advance(time.Minute)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("commit", nil)
+
+	// Retained commits keep what expired since.
+	database.vacuum()
+	assertEq(versionCount(database, "x"), 1, "versions while retained")
+	c.mustExecCommand("begin", []string{"asof", "1"})
+	res := c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "asof 1 get x")
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", []string{"asof", "2"})
+	_, err := c.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "asof 2 get x")
+	c.mustExecCommand("commit", nil)
+
+	// Once they aren't retained, it can go, and reading as of a
+	// commit that still saw it is too old.
+	database.retainCommits = 0
+	database.vacuum()
+	assertEq(versionCount(database, "x"), 0, "versions after retention")
+	_, err = c.execCommand("begin", []string{"asof", "1"})
+	assertEq(err, errSnapshotTooOld, "asof 1 after vacuum")
+}
+
+func TestTTL_wal(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	database := mustOpenDatabase(dir)
+	database.clock = clock.Now
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1", "ttl=10"})
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("commit", nil)
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	database.clock = clock.Now
+	c = database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 y=2", "scan before expiry")
+	c.mustExecCommand("commit", nil)
+
+	clock.advance(10 * time.Second)
+	txId := c.mustExecCommand("begin", nil)
+	res = c.mustExecCommand("scan", []string{""})
+	assertEq(res, "y=2", "scan after expiry")
+	c.mustExecCommand("set", []string{"z", "3"})
+	c.mustExecCommand("commit", nil)
+	assertEq(database.close(), nil, "close again")
+
+	// So is when transactions committed, which is when values
+	// expire by for those reading as of them.
+	database = mustOpenDatabase(dir)
+	defer database.close()
+	database.clock = clock.Now
+	c = database.newConnection()
+	c.mustExecCommand("begin", []string{"asof", "1"})
+	res = c.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 y=2", "scan as of 1")
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", []string{"asof", txId})
+	res = c.mustExecCommand("scan", []string{""})
+	assertEq(res, "y=2 z=3", "scan as of "+txId)
+}
+
+// Deleting a key that has an expiry is logged as a delete.
+func TestTTL_walDelete(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+	database.retainCommitLog(10)
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1", "ttl=60"})
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("delete", []string{"x"})
+	c.mustExecCommand("commit", nil)
+	records, _ := database.readCommits(&commitReader{position: 1})
+	assertEq(records[0].changes[0].deleted, true, "commit log delete")
+	assertEq(records[0].changes[0].expiresAt.IsZero(), true, "commit log expiry")
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	defer database.close()
+	c = database.newConnection()
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "get x after recovery")
+	c.mustExecCommand("commit", nil)
+}
+
+// Replicas are told when values expire, not how long they have left.
+func TestTTL_replication(t *testing.T) {
+	leader, clock := newTTLDatabase()
+	leader.retainCommitLog(10)
+	c := leader.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1", "ttl=10"})
+	c.mustExecCommand("commit", nil)
+
+	replica, s, conn := connectReplica(leader)
+	defer conn.Close()
+	replica.clock = clock.Now
+	clock.advance(5 * time.Second)
+	assertEq(s.applyNext(), nil, "apply")
+
+	r := replica.newConnection()
+	r.mustExecCommand("begin", nil)
+	res := r.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "replica get x")
+	r.mustExecCommand("commit", nil)
+
+	clock.advance(5 * time.Second)
+	r.mustExecCommand("begin", nil)
+	_, err := r.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "replica get x after expiry")
+}
+
+// A replica applies a delete the leader made before the value expired,
+// even if it has expired by the time the replica does.
+func TestTTL_replicationDelete(t *testing.T) {
+	leader, clock := newTTLDatabase()
+	leader.retainCommitLog(10)
+	c1 := leader.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1", "ttl=10"})
+	c1.mustExecCommand("commit", nil)
+	c2 := leader.newConnection()
+	c2.mustExecCommand("begin", nil)
+	clock.advance(20 * time.Second)
+	c2.mustExecCommand("delete", []string{"x"})
+	c2.mustExecCommand("commit", nil)
+
+	replica, s, conn := connectReplica(leader)
+	defer conn.Close()
+	replica.clock = clock.Now
+	assertEq(s.applyNext(), nil, "apply set")
+	assertEq(s.applyNext(), nil, "apply delete")
+
+	chain, _ := replica.store.Get("x")
+	assertEq(len(chain.versions), 1, "versions")
+	assert(chain.versions[0].txEndId != 0, "version closed")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Two-phase commit, for transactions that span several databases, as
+// in Postgres. A transaction is first prepared under a global id, which
+// runs the checks commit would and makes its writes durable. It is then
+// committed or aborted by that id from any connection, even after the
+// database is reopened. Once prepared, it can't fail to commit.
+//
+// A prepared transaction takes its place in the commit order when it is
+// prepared, so the conflict checks of other transactions treat it as
+// committed already. Its writes are only visible once it commits.
+
+// Whether the transaction was prepared, whatever became of it since.
+func (t *Transaction) prepared() bool {
+	return t.gid != ""
+}
+
+// Whether conflict checks treat the transaction as committed, which
+// they also do while its commit record is being synced.
+func (t *Transaction) committedOrPrepared() bool {
+	return t.state == CommittedTransaction || t.state == InProgressTransaction && (t.prepared() || t.committing)
+}
+
+// Prepares the transaction as gid. If it can't be, it is aborted.
+func (d *Database) prepareTransaction(t *Transaction, gid string) error {
+	d.txMu.Lock()
+	err := d.prepareTransactionLocked(t, gid)
+	d.txMu.Unlock()
+
+	// A prepared transaction keeps its locks until it completes.
+	if err != nil && (d.concurrency == TwoPhaseLocking || d.writeConflicts == FirstUpdaterWins) {
+		d.locks.releaseAll(t.id)
+	}
+	return err
+}
+
+func (d *Database) prepareTransactionLocked(t *Transaction, gid string) error {
+	if _, ok := d.prepared[gid]; ok {
+		d.completeTransactionLocked(t, AbortedTransaction, abortRequested)
+		return fmt.Errorf("transaction %q already prepared", gid)
+	}
+
+	earliestOutConflict, err := d.checkCommitLocked(t)
+	if err != nil {
+		return err
+	}
+
+	if err := d.log(walRecord{op: walPrepare, txId: t.id, key: gid}); err != nil {
+		d.completeTransactionLocked(t, AbortedTransaction, abortWALError)
+		return err
+	}
+
+	t.gid = gid
+	t.commitSeq = d.nextCommitSeq
+	d.nextCommitSeq++
+	t.earliestOutConflict = earliestOutConflict
+	d.prepared[gid] = t
+	return nil
+}
+
+// Commits or aborts the transaction prepared as gid.
+func (d *Database) completePrepared(gid string, state TransactionState) error {
+	d.txMu.RLock()
+	t, ok := d.prepared[gid]
+	d.txMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no prepared transaction %q", gid)
+	}
+	return d.completeTransaction(t, state, abortRequested)
+}
+
+// The global ids of the prepared transactions, in order.
+func (d *Database) preparedIds() []string {
+	d.txMu.RLock()
+	defer d.txMu.RUnlock()
+
+	var gids []string
+	for gid := range d.prepared {
+		gids = append(gids, gid)
+	}
+	slices.Sort(gids)
+	return gids
+}
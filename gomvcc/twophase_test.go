@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPrepare(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("prepare", []string{"g1"})
+	assert(c1.tx == nil, "c1 has no transaction")
+
+	// Prepared is not committed.
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	_, err := c2.execCommand("get", []string{"x"})
+	assertEq(err.Error(), "key not found", "c2 get x")
+	c2.mustExecCommand("abort", nil)
+
+	res := c2.mustExecCommand("show", []string{"transactions"})
+	assertEq(res, `1 in progress (snapshot, prepared "g1"); 2 aborted`, "show transactions")
+	assertEq(len(database.preparedIds()), 1, "prepared")
+
+	c2.mustExecCommand("commitprepared", []string{"g1"})
+	_, err = c2.execCommand("commitprepared", []string{"g1"})
+	assertEq(err.Error(), `no prepared transaction "g1"`, "commitprepared twice")
+	_, err = c2.execCommand("abortprepared", []string{"g1"})
+	assertEq(err.Error(), `no prepared transaction "g1"`, "abortprepared after commit")
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res = c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c3 get x")
+}
+
+func TestPrepare_abort(t *testing.T) {
+	database := newDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("prepare", []string{"g1"})
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "1"})
+	_, err := c2.execCommand("prepare", []string{"g1"})
+	assertEq(err.Error(), `transaction "g1" already prepared`, "c2 prepare g1")
+	assert(c2.tx == nil, "c2 aborted")
+
+	c2.mustExecCommand("abortprepared", []string{"g1"})
+	c2.mustExecCommand("begin", nil)
+	res := c2.mustExecCommand("scan", []string{""})
+	assertEq(res, "", "c2 scan")
+}
+
+// Others commit as if the prepared transaction had committed already.
+func TestPrepare_conflict(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("prepare", []string{"g1"})
+
+	c2.mustExecCommand("set", []string{"x", "2"})
+	_, err := c2.execCommand("commit", nil)
+	assertEq(err.Error(), `write-write conflict with transaction 1 on "x"`, "c2 commit")
+
+	// And the checks commit would run are run on prepare.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	c3.mustExecCommand("set", []string{"y", "3"})
+	c4.mustExecCommand("set", []string{"y", "4"})
+	c3.mustExecCommand("commit", nil)
+	_, err = c4.execCommand("prepare", []string{"g4"})
+	assertEq(err.Error(), `write-write conflict with transaction 3 on "y"`, "c4 prepare")
+	assertEq(len(database.preparedIds()), 1, "prepared")
+}
+
+// The prepared transaction is the pivot of c1 -rw-> prepared -rw-> c3,
+// and c3 committed first, so c1 can't commit, as the prepared
+// transaction can't be aborted anymore.
+func TestPrepare_serializable(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SerializableIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c2.execCommand("get", []string{"y"})
+	c3.mustExecCommand("set", []string{"y", "3"})
+	c3.mustExecCommand("commit", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("prepare", []string{"g2"})
+
+	c1.execCommand("get", []string{"x"})
+	c1.mustExecCommand("set", []string{"z", "1"})
+	_, err := c1.execCommand("commit", nil)
+	assertEq(err.Error(), `read-write conflict with transaction 2 on "x"`, "c1 commit")
+
+	c1.mustExecCommand("commitprepared", []string{"g2"})
+}
+
+func TestPrepare_twoPhaseLocking(t *testing.T) {
+	database := newLockingDatabase()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("prepare", []string{"g1"})
+
+	// The locks are kept until the transaction completes.
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	done := make(chan string)
+	go func() {
+		done <- c2.mustExecCommand("incr", []string{"x", "1"})
+	}()
+	waitUntilBlocked(database, c2.tx.id)
+
+	c1.mustExecCommand("commitprepared", []string{"g1"})
+	assertEq(<-done, "2", "c2 incr x")
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestPrepare_wal(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("prepare", []string{"g1"})
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("prepare", []string{"g2"})
+	c.mustExecCommand("abortprepared", []string{"g2"})
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"z", "3"})
+	c.mustExecCommand("prepare", []string{"g3"})
+	c.mustExecCommand("commitprepared", []string{"g3"})
+	assertEq(database.close(), nil, "close")
+
+	// g1 is still prepared after a restart, and nobody sees it yet.
+	database = mustOpenDatabase(dir)
+	assertEq(len(database.preparedIds()), 1, "prepared")
+	assertEq(database.preparedIds()[0], "g1", "prepared")
+	c = database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("scan", []string{""})
+	assertEq(res, "z=3", "scan before commitprepared")
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("commitprepared", []string{"g1"})
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	defer database.close()
+	assertEq(len(database.preparedIds()), 0, "prepared")
+	c = database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res = c.mustExecCommand("scan", []string{""})
+	assertEq(res, "x=1 z=3", "scan after commitprepared")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+// What a single vacuum run reclaimed.
+type VacuumStats struct {
+	// Every transaction older than this has completed and its
+	// effects are visible to every live transaction.
+	horizon      uint64
+	versions     int
+	transactions int
+}
+
+// The oldest transaction id that a live transaction may still need to
+// tell apart from the ones before it. It is the smallest xmin of the
+// snapshots of the transactions in progress, or of the transactions
+// that hadn't committed yet for those reading as of a past one. The
+// caller must hold txMu.
+func (d *Database) oldestActiveSnapshot() uint64 {
+	horizon := d.nextTransactionId
+	iter := d.active.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t, _ := d.transactions.Get(iter.Key())
+		horizon = min(horizon, t.snapshot.xmin)
+		if t.asof > 0 {
+			horizon = min(horizon, t.asofHorizon)
+		}
+	}
+	return horizon
+}
+
+// Removes versions that no live transaction can see anymore, and the
+// records of transactions older than the oldest active snapshot.
+func (d *Database) vacuum() VacuumStats {
+	d.vacuumMu.Lock()
+	defer d.vacuumMu.Unlock()
+
+	// Transactions that start from now on only have transactions
+	// at or after the horizon in their snapshots.
+	d.txMu.Lock()
+	stats := VacuumStats{horizon: min(d.oldestActiveSnapshot(), d.retentionHorizon())}
+	expiredBefore := d.oldestActiveSnapshotTime()
+	if retained := d.retentionTime(); retained.Before(expiredBefore) {
+		expiredBefore = retained
+	}
+	d.completedSinceVacuum = 0
+	// Reading as of a transaction that committed before what is
+	// about to be removed must fail from now on, not once it is
+	// gone. Only finished transactions can be before the horizon.
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok && iter.Key() < stats.horizon; ok = iter.Next() {
+		d.vacuumedCommitSeq = max(d.vacuumedCommitSeq, iter.Value().commitSeq)
+	}
+	d.vacuumHorizon = max(d.vacuumHorizon, stats.horizon)
+	d.vacuumingExpiredBefore = expiredBefore
+	d.txMu.Unlock()
+
+	// The state of the transaction a version was created or deleted
+	// by, if it finished before the horizon.
+	finished := func(txId uint64) (TransactionState, bool) {
+		if txId == 0 || txId >= stats.horizon {
+			return InProgressTransaction, false
+		}
+		return d.transactionState(txId), true
+	}
+
+	// Nobody else can use a version chain while this is held.
+	d.storeMu.Lock()
+	defer d.storeMu.Unlock()
+
+	// The latest expiry of the expired versions removed.
+	var latestExpiry time.Time
+
+	// Removes the versions nobody can see from chains, and the
+	// chains left empty, and returns how many it removed.
+	vacuumChains := func(chains *btree.Map[string, *versionChain]) int {
+		removed := 0
+		// The chains can't be changed while iterating over them.
+		changed := map[string][]Value{}
+		chains.Scan(func(key string, chain *versionChain) bool {
+			versions := chain.versions
+			live := versions[:0]
+			for _, v := range versions {
+				// Nobody should see what aborted transactions wrote.
+				if d.transactionState(v.txStartId) == AbortedTransaction {
+					removed++
+					continue
+				}
+
+				// Nor what expired before the snapshot of
+				// every live transaction was taken, and of any
+				// that is yet to begin, including those reading
+				// as of a retained commit.
+				if !v.expiresAt.IsZero() && v.expiresAt.Before(expiredBefore) {
+					if v.expiresAt.After(latestExpiry) {
+						latestExpiry = v.expiresAt
+					}
+					removed++
+					continue
+				}
+
+				if state, ok := finished(v.txEndId); ok {
+					// Deleted before every live snapshot.
+					if state == CommittedTransaction {
+						removed++
+						continue
+					}
+
+					// The delete was aborted, so once its record
+					// is gone the version must look like it was
+					// never deleted.
+					v.txEndId = 0
+				}
+
+				live = append(live, v)
+			}
+
+			if len(live) < len(versions) {
+				// Let the removed versions be garbage collected.
+				clear(versions[len(live):])
+				changed[key] = live
+			}
+			return true
+		})
+		for key, live := range changed {
+			if len(live) == 0 {
+				chains.Delete(key)
+			} else {
+				chain, _ := chains.Get(key)
+				chain.versions = live
+			}
+		}
+		return removed
+	}
+	stats.versions = vacuumChains(&d.store)
+	// Index entries go with the versions they are for.
+	for _, ix := range d.indexes {
+		vacuumChains(&ix.entries)
+	}
+
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+	var old []uint64
+	iter = d.transactions.Iter()
+	for ok := iter.First(); ok && iter.Key() < stats.horizon; ok = iter.Next() {
+		old = append(old, iter.Key())
+	}
+	for _, id := range old {
+		d.transactions.Delete(id)
+	}
+	stats.transactions = len(old)
+	if latestExpiry.After(d.vacuumedExpiresAt) {
+		d.vacuumedExpiresAt = latestExpiry
+	}
+	d.vacuumingExpiredBefore = time.Time{}
+
+	debug("vacuum up to", stats.horizon, "removed", stats.versions, "versions and", stats.transactions, "transactions")
+
+	return stats
+}
+
+// Runs vacuum in the background, so no commit waits for it.
+type autovacuumWorker struct {
+	requests chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	// How many times it has run vacuum.
+	runs atomic.Uint64
+}
+
+// Vacuums in the background after every threshold completed
+// transactions, until the database is closed.
+func (d *Database) startAutovacuum(threshold uint64) {
+	w := &autovacuumWorker{
+		// Requests made while vacuum runs, or before it starts,
+		// are served by a single run.
+		requests: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	d.txMu.Lock()
+	d.autovacuumThreshold = threshold
+	d.autovacuum = w
+	d.txMu.Unlock()
+	go func() {
+		defer close(w.stopped)
+		for {
+			select {
+			case <-w.requests:
+				d.vacuum()
+				w.runs.Add(1)
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Asks for vacuum to run, without waiting for it.
+func (w *autovacuumWorker) request() {
+	select {
+	case w.requests <- struct{}{}:
+	default:
+	}
+}
+
+// Stops vacuuming in the background, waiting for a run in progress.
+func (d *Database) stopAutovacuum() {
+	d.txMu.Lock()
+	w := d.autovacuum
+	d.autovacuum = nil
+	d.autovacuumThreshold = 0
+	d.txMu.Unlock()
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.stopped
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func versionCount(database *Database, key string) int {
+	chain, ok := database.store.Get(key)
+	if !ok {
+		return 0
+	}
+	return len(chain.versions)
+}
+
+func TestVacuum(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+
+	for _, value := range []string{"1", "2", "3"} {
+		c := database.newConnection()
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+	assertEq(versionCount(&database, "x"), 3, "versions before vacuum")
+
+	c1 := database.newConnection()
+	res := c1.mustExecCommand("vacuum", nil)
+	assertEq(res, "versions=2 transactions=3", "c1 vacuum")
+	assertEq(versionCount(&database, "x"), 1, "versions after vacuum")
+	assertEq(database.transactions.Len(), 0, "transactions after vacuum")
+
+	// Nothing else to reclaim.
+	res = c1.mustExecCommand("vacuum", nil)
+	assertEq(res, "versions=0 transactions=0", "c1 vacuum")
+
+	// The surviving version is still visible to new transactions.
+	c1.mustExecCommand("begin", nil)
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "3", "c1 get x")
+	c1.mustExecCommand("delete", []string{"x"})
+	c1.mustExecCommand("commit", nil)
+
+	// Deleted keys disappear altogether.
+	c1.mustExecCommand("vacuum", nil)
+	_, ok := database.store.Get("x")
+	assertEq(ok, false, "x in store")
+}
+
+func TestVacuum_keepsVersionsVisibleToActiveSnapshots(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = RepeatableReadIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	res := c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c2 get x")
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("set", []string{"x", "2"})
+	c3.mustExecCommand("commit", nil)
+
+	// c2 still needs the first version, and c3 is newer than the
+	// oldest active snapshot.
+	stats := database.vacuum()
+	assertEq(stats.horizon, uint64(2), "horizon")
+	assertEq(stats.versions, 0, "versions")
+	assertEq(stats.transactions, 1, "transactions")
+
+	res = c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c2 get x")
+	c2.mustExecCommand("commit", nil)
+
+	stats = database.vacuum()
+	assertEq(stats.horizon, uint64(4), "horizon")
+	assertEq(stats.versions, 1, "versions")
+	assertEq(stats.transactions, 2, "transactions")
+
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	res = c4.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "c4 get x")
+}
+
+func TestVacuum_abortedTransactions(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = ReadUncommittedIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "1"})
+	c2.mustExecCommand("delete", []string{"x"})
+	c2.mustExecCommand("abort", nil)
+
+	stats := database.vacuum()
+	assertEq(stats.versions, 1, "versions")
+	assertEq(stats.transactions, 2, "transactions")
+
+	// The aborted delete is undone.
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res := c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c3 get x")
+
+	// And the aborted set is gone.
+	_, err := c3.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "c3 get y")
+	_, ok := database.store.Get("y")
+	assertEq(ok, false, "y in store")
+}
+
+// Waits until autovacuum has run n times.
+func waitForAutovacuum(database *Database, n uint64) {
+	for i := 0; i < 1000; i++ {
+		if database.autovacuum.runs.Load() >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	panic("autovacuum didn't run")
+}
+
+func TestAutovacuum(t *testing.T) {
+	database := newDatabase()
+	database.defaultIsolation = SnapshotIsolation
+	database.startAutovacuum(2)
+	defer database.close()
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("commit", nil)
+	assertEq(database.autovacuum.runs.Load(), uint64(0), "runs after first commit")
+
+	// The commit only asks for it, and vacuum runs in the
+	// background.
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("commit", nil)
+	waitForAutovacuum(&database, 1)
+	database.txMu.RLock()
+	assertEq(database.transactions.Len(), 0, "transactions after second commit")
+	database.txMu.RUnlock()
+	assertEq(versionCount(&database, "x"), 1, "versions after second commit")
+
+	c1.mustExecCommand("begin", nil)
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "c1 get x")
+	c1.mustExecCommand("commit", nil)
+
+	// Nothing runs once the database is closed.
+	assertEq(database.close(), nil, "close")
+	for i := 0; i < 4; i++ {
+		c1.mustExecCommand("begin", nil)
+		c1.mustExecCommand("commit", nil)
+	}
+	database.txMu.RLock()
+	assertEq(database.transactions.Len(), 5, "transactions after close")
+	database.txMu.RUnlock()
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type walOp uint8
+
+const (
+	walBegin walOp = iota + 1
+	walSet
+	walDelete
+	walCommit
+	walAbort
+	// The key of these is the name of the savepoint.
+	walSavepoint
+	walRollback
+	walRelease
+	// Not part of any transaction. The key is the name of the
+	// index.
+	walCreateIndex
+	// The key is the global id the transaction was prepared as.
+	walPrepare
+	// A walSet of a value that expires.
+	walExpiringSet
+)
+
+type walRecord struct {
+	op    walOp
+	txId  uint64
+	key   string
+	value string
+	// Only for writes, the ids of the transactions that created the
+	// versions the write closed.
+	closes []uint64
+	// Only for walExpiringSet, in unix nanoseconds.
+	expiresAt int64
+	// Only for walCommit, in unix nanoseconds.
+	committedAt int64
+}
+
+func (op walOp) write() bool {
+	return op == walSet || op == walExpiringSet || op == walDelete
+}
+
+// Every record is written as
+//
+//	length   uint32, of the payload
+//	checksum uint32, crc32c of the payload
+//	payload  op, txId, key and value, then closes for writes,
+//	         expiresAt for walExpiringSet, and committedAt for
+//	         walCommit
+//
+// so that a torn write or a corrupted tail can be told apart from a
+// complete record.
+const walHeaderSize = 8
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptRecord = errors.New("corrupt wal record")
+
+func (r walRecord) encode() []byte {
+	payload := []byte{byte(r.op)}
+	payload = binary.AppendUvarint(payload, r.txId)
+	payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+	payload = append(payload, r.key...)
+	payload = binary.AppendUvarint(payload, uint64(len(r.value)))
+	payload = append(payload, r.value...)
+	if r.op.write() {
+		payload = binary.AppendUvarint(payload, uint64(len(r.closes)))
+		for _, id := range r.closes {
+			payload = binary.AppendUvarint(payload, id)
+		}
+	}
+	if r.op == walExpiringSet {
+		payload = binary.AppendVarint(payload, r.expiresAt)
+	}
+	if r.op == walCommit {
+		payload = binary.AppendVarint(payload, r.committedAt)
+	}
+
+	buf := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, walTable))
+	return append(buf, payload...)
+}
+
+func decodeWalRecord(payload []byte) (walRecord, error) {
+	var r walRecord
+	if len(payload) == 0 {
+		return r, errCorruptRecord
+	}
+	r.op = walOp(payload[0])
+	payload = payload[1:]
+
+	txId, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return r, errCorruptRecord
+	}
+	r.txId = txId
+	payload = payload[n:]
+
+	readString := func() (string, error) {
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < length {
+			return "", errCorruptRecord
+		}
+		s := string(payload[n : n+int(length)])
+		payload = payload[n+int(length):]
+		return s, nil
+	}
+
+	var err error
+	if r.key, err = readString(); err != nil {
+		return r, err
+	}
+	if r.value, err = readString(); err != nil {
+		return r, err
+	}
+	if r.op.write() {
+		count, n := binary.Uvarint(payload)
+		if n <= 0 || count > uint64(len(payload)) {
+			return r, errCorruptRecord
+		}
+		payload = payload[n:]
+		for i := uint64(0); i < count; i++ {
+			id, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return r, errCorruptRecord
+			}
+			r.closes = append(r.closes, id)
+			payload = payload[n:]
+		}
+	}
+	if r.op == walExpiringSet {
+		expiresAt, n := binary.Varint(payload)
+		if n <= 0 {
+			return r, errCorruptRecord
+		}
+		r.expiresAt = expiresAt
+		payload = payload[n:]
+	}
+	if r.op == walCommit {
+		committedAt, n := binary.Varint(payload)
+		if n <= 0 {
+			return r, errCorruptRecord
+		}
+		r.committedAt = committedAt
+		payload = payload[n:]
+	}
+	if len(payload) > 0 || r.op < walBegin || r.op > walExpiringSet {
+		return r, errCorruptRecord
+	}
+	return r, nil
+}
+
+type wal struct {
+	mu sync.Mutex
+	f  *os.File
+	// Called before each sync, which fails with its error if it
+	// returns one. For tests.
+	beforeSync func() error
+}
+
+// Opens, or creates, the log in dir and returns every complete record
+// in it. Anything after the last complete record was never
+// acknowledged, so it is cut off before new records are appended.
+func openWAL(dir string) (*wal, []walRecord, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	var records []walRecord
+	var valid int64
+	r := bufio.NewReader(f)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if valid+walHeaderSize+int64(length) > info.Size() {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		record, err := decodeWalRecord(payload)
+		if err != nil {
+			break
+		}
+		records = append(records, record)
+		valid += walHeaderSize + int64(length)
+	}
+
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &wal{f: f}, records, nil
+}
+
+func (w *wal) append(r walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.f.Write(r.encode())
+	return err
+}
+
+func (w *wal) sync() error {
+	if w.beforeSync != nil {
+		if err := w.beforeSync(); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Sync()
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// Appends r to the log, if there is one. Commits, and prepares, are
+// only durable once synced. Commits are synced by completeTransaction,
+// without holding txMu.
+func (d *Database) log(r walRecord) error {
+	if d.wal == nil {
+		return nil
+	}
+	if err := d.wal.append(r); err != nil {
+		return err
+	}
+	if r.op == walPrepare || r.op == walCreateIndex {
+		return d.wal.sync()
+	}
+	return nil
+}
+
+// Opens the database logged in dir, replaying every transaction that
+// committed before it was last closed or crashed. Transactions that
+// were still in progress are treated as aborted, unless they were
+// prepared, in which case they are prepared again.
+func openDatabase(dir string) (*Database, error) {
+	w, records, err := openWAL(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDatabase()
+	d.replay(records)
+	d.wal = w
+
+	debug("replayed", len(records), "wal records from", dir)
+
+	return &d, nil
+}
+
+func (d *Database) replay(records []walRecord) {
+	committed := map[uint64]bool{}
+	// Prepared transactions that neither committed nor aborted
+	// since.
+	inDoubt := map[uint64]bool{}
+	for _, r := range records {
+		switch r.op {
+		case walCommit:
+			committed[r.txId] = true
+			delete(inDoubt, r.txId)
+		case walPrepare:
+			inDoubt[r.txId] = true
+		case walAbort:
+			delete(inDoubt, r.txId)
+		}
+	}
+
+	// Writes rolled back to a savepoint are skipped like those of
+	// aborted transactions.
+	type replaySavepoint struct {
+		name   string
+		writes int
+	}
+	writes := map[uint64][]int{}
+	savepoints := map[uint64][]replaySavepoint{}
+	rolledBack := map[int]bool{}
+	for i, r := range records {
+		sps := savepoints[r.txId]
+		switch r.op {
+		case walSet, walExpiringSet, walDelete:
+			writes[r.txId] = append(writes[r.txId], i)
+		case walSavepoint:
+			savepoints[r.txId] = append(sps, replaySavepoint{r.key, len(writes[r.txId])})
+		case walRollback, walRelease:
+			j := len(sps) - 1
+			for j >= 0 && sps[j].name != r.key {
+				j--
+			}
+			if j < 0 {
+				continue
+			}
+			if r.op == walRelease {
+				savepoints[r.txId] = sps[:j]
+				continue
+			}
+			for _, w := range writes[r.txId][sps[j].writes:] {
+				rolledBack[w] = true
+			}
+			writes[r.txId] = writes[r.txId][:sps[j].writes]
+			savepoints[r.txId] = sps[:j+1]
+		}
+	}
+
+	var indexes []string
+	changes := map[uint64][]change{}
+	for i, r := range records {
+		if r.op == walCreateIndex {
+			indexes = append(indexes, r.key)
+			continue
+		}
+		if r.txId >= d.nextTransactionId {
+			d.nextTransactionId = r.txId + 1
+		}
+
+		t, ok := d.transactions.Get(r.txId)
+		if !ok {
+			t = &Transaction{id: r.txId, state: AbortedTransaction}
+			d.transactions.Set(t.id, t)
+		}
+
+		switch r.op {
+		case walSet, walExpiringSet, walDelete:
+			if !committed[r.txId] && !inDoubt[r.txId] || rolledBack[i] {
+				continue
+			}
+			t.writeset.Insert(r.key)
+			var expiresAt time.Time
+			if r.op == walExpiringSet {
+				expiresAt = time.Unix(0, r.expiresAt)
+			}
+
+			// Each write closes the versions that were visible
+			// to it, which aren't always the latest ones, as
+			// under Read Committed a version can be replaced by
+			// a transaction that didn't see the one replacing
+			// it. None of them was its creator's own earlier
+			// version, which only its creator ever sees. The
+			// newest of them is the one it replaced.
+			c := change{key: r.key, value: r.value, deleted: r.op == walDelete, expiresAt: expiresAt}
+			chain, ok := d.store.Get(r.key)
+			if !ok && r.op == walDelete {
+				changes[r.txId] = append(changes[r.txId], c)
+				continue
+			}
+			if !ok {
+				chain = &versionChain{}
+				d.store.Set(r.key, chain)
+			}
+			for i := len(chain.versions) - 1; i >= 0; i-- {
+				v := &chain.versions[i]
+				if v.txEndId == v.txStartId || !slices.Contains(r.closes, v.txStartId) {
+					continue
+				}
+				if !c.existed {
+					c.oldValue, c.existed = v.value, true
+				}
+				v.txEndId = r.txId
+			}
+			changes[r.txId] = append(changes[r.txId], c)
+			if r.op != walDelete {
+				chain.versions = append(chain.versions, Value{txStartId: r.txId, value: r.value, expiresAt: expiresAt})
+			}
+		case walPrepare:
+			t.gid = r.key
+			t.commitSeq = d.nextCommitSeq
+			d.nextCommitSeq++
+			if inDoubt[r.txId] {
+				// It reads nothing anymore, so its
+				// snapshot holds nothing back.
+				t.state = InProgressTransaction
+				t.snapshot = snapshot{xmin: t.id, xmax: t.id}
+				t.changes = changes[r.txId]
+				d.active.Insert(t.id)
+				d.prepared[r.key] = t
+			}
+		case walCommit:
+			t.state = CommittedTransaction
+			t.committedAt = time.Unix(0, r.committedAt)
+			if !t.prepared() {
+				t.commitSeq = d.nextCommitSeq
+				d.nextCommitSeq++
+			}
+			// The commit log is kept whole until
+			// retainCommitLog says how much of it to keep.
+			d.commitLog = append(d.commitLog, newCommitRecord(t.id, changes[r.txId]))
+			delete(changes, r.txId)
+		}
+	}
+
+	// Indexes are built from what was replayed, wherever they were
+	// created in the log.
+	for _, name := range indexes {
+		d.createIndexLocked(name)
+	}
+}
+
+func (d *Database) close() error {
+	d.stopAutovacuum()
+	if d.wal == nil {
+		return nil
+	}
+	err := d.wal.close()
+	d.wal = nil
+	return err
+}
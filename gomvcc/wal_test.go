@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustOpenDatabase(dir string) *Database {
+	database, err := openDatabase(dir)
+	assertEq(err, nil, "open database")
+	return database
+}
+
+func TestWAL_recovery(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+	database.defaultIsolation = SnapshotIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("set", []string{"y", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("delete", []string{"y"})
+
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("set", []string{"z", "3"})
+	c3.mustExecCommand("abort", nil)
+
+	c4 := database.newConnection()
+	c4.mustExecCommand("begin", nil)
+	c4.mustExecCommand("set", []string{"w", "4"})
+
+	c2.mustExecCommand("commit", nil)
+
+	// Crash with c4 still in progress.
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	defer database.close()
+
+	assertEq(database.transactionState(1), CommittedTransaction, "c1 state")
+	assertEq(database.transactionState(2), CommittedTransaction, "c2 state")
+	assertEq(database.transactionState(3), AbortedTransaction, "c3 state")
+	assertEq(database.transactionState(4), AbortedTransaction, "c4 state")
+
+	c5 := database.newConnection()
+	res := c5.mustExecCommand("begin", nil)
+	assertEq(res, "5", "c5 begin")
+
+	res = c5.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "c5 get x")
+
+	for _, key := range []string{"y", "z", "w"} {
+		_, err := c5.execCommand("get", []string{key})
+		assertEq(err.Error(), "key not found", "c5 get "+key)
+	}
+	c5.mustExecCommand("commit", nil)
+}
+
+// Under Read Committed a write can close a version that isn't the
+// latest, and recovery must close the same ones.
+func TestWAL_recoveryReadCommitted(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "1"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "2"})
+	// c1 doesn't see c2's set, so it only deletes x=1.
+	c1.mustExecCommand("delete", []string{"x"})
+	c2.mustExecCommand("commit", nil)
+	c1.mustExecCommand("commit", nil)
+
+	c0.mustExecCommand("begin", nil)
+	res := c0.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "get x")
+	c0.mustExecCommand("commit", nil)
+	assertEq(database.close(), nil, "close")
+
+	assertRecoveredX(dir, "2")
+}
+
+// Everything a new transaction sees.
+func scanAll(database *Database) string {
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	defer c.mustExecCommand("commit", nil)
+	return c.mustExecCommand("scan", []string{""})
+}
+
+// Recovery ends up with what the database had, whichever of the
+// concurrent writes to a key committed.
+func TestWAL_recoveryMatchesLive(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+	database.defaultIsolation = SnapshotIsolation
+
+	c0 := database.newConnection()
+	c0.mustExecCommand("begin", nil)
+	for _, key := range []string{"x", "y", "z"} {
+		c0.mustExecCommand("set", []string{key, "0"})
+	}
+	c0.mustExecCommand("commit", nil)
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c1.mustExecCommand("delete", []string{"x"})
+	c1.mustExecCommand("set", []string{"y", "1"})
+	_, err := c2.execCommand("set", []string{"x", "2"})
+	assert(errors.Is(err, ErrConflict), "c2 set x")
+	c3.mustExecCommand("set", []string{"z", "3"})
+	c1.mustExecCommand("commit", nil)
+	c3.mustExecCommand("abort", nil)
+
+	live := scanAll(database)
+	assertEq(live, "y=1 z=0", "scan")
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	defer database.close()
+	assertEq(scanAll(database), live, "scan after recovery")
+}
+
+// Commit records are synced without holding txMu, so reads and other
+// commits don't wait for them.
+func TestWAL_commitSync(t *testing.T) {
+	database := mustOpenDatabase(t.TempDir())
+	defer database.close()
+	database.defaultIsolation = SnapshotIsolation
+
+	c1 := database.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	syncing, release := make(chan struct{}), make(chan struct{})
+	database.wal.beforeSync = func() error {
+		close(syncing)
+		<-release
+		return nil
+	}
+	c2 := database.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c3 := database.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "2"})
+	committed := make(chan error)
+	go func() {
+		_, err := c1.execCommand("commit", nil)
+		committed <- err
+	}()
+	<-syncing
+
+	// c1 isn't committed yet, but conflicts as if it was.
+	res := c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c2 get x")
+	_, err := c3.execCommand("set", []string{"x", "3"})
+	assert(errors.Is(err, ErrConflict), "c3 set x")
+
+	close(release)
+	assertEq(<-committed, nil, "c1 commit")
+	database.wal.beforeSync = nil
+	c2.mustExecCommand("commit", nil)
+	c2.mustExecCommand("begin", nil)
+	res = c2.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "c2 get x after c1 committed")
+	c2.mustExecCommand("commit", nil)
+
+	// A commit that can't be synced is aborted.
+	database.wal.beforeSync = func() error { return errors.New("disk on fire") }
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "4"})
+	_, err = c1.execCommand("commit", nil)
+	assertEq(err.Error(), "disk on fire", "c1 commit")
+	assertEq(database.transactionState(6), AbortedTransaction, "c1 state")
+}
+
+func TestWAL_recoveryIsRepeatable(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every reopen continues the same log.
+	for i, value := range []string{"1", "2", "3"} {
+		database := mustOpenDatabase(dir)
+
+		c := database.newConnection()
+		c.mustExecCommand("begin", nil)
+		if i > 0 {
+			res := c.mustExecCommand("get", []string{"x"})
+			assertEq(res, []string{"1", "2", "3"}[i-1], "get x")
+		}
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+
+		assertEq(database.close(), nil, "close")
+	}
+}
+
+func TestWAL_savepoints(t *testing.T) {
+	dir := t.TempDir()
+	database := mustOpenDatabase(dir)
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("savepoint", []string{"a"})
+	c.mustExecCommand("set", []string{"x", "2"})
+	c.mustExecCommand("savepoint", []string{"b"})
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("rollback", []string{"to", "a"})
+	c.mustExecCommand("savepoint", []string{"c"})
+	c.mustExecCommand("set", []string{"z", "3"})
+	c.mustExecCommand("release", []string{"c"})
+	c.mustExecCommand("commit", nil)
+
+	assertEq(database.close(), nil, "close")
+
+	database = mustOpenDatabase(dir)
+	defer database.close()
+
+	c = database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "get x")
+	_, err := c.execCommand("get", []string{"y"})
+	assertEq(err.Error(), "key not found", "get y")
+	res = c.mustExecCommand("get", []string{"z"})
+	assertEq(res, "3", "get z")
+	c.mustExecCommand("commit", nil)
+}
+
+// Writes x=1 and then x=2 in two transactions, and returns the size
+// of the log after the first one.
+func writeTwoCommits(dir string) int64 {
+	database := mustOpenDatabase(dir)
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	info, err := os.Stat(filepath.Join(dir, "wal.log"))
+	assertEq(err, nil, "stat")
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "2"})
+	c.mustExecCommand("commit", nil)
+
+	assertEq(database.close(), nil, "close")
+	return info.Size()
+}
+
+func assertRecoveredX(dir string, expected string) {
+	database := mustOpenDatabase(dir)
+	defer database.close()
+
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("get", []string{"x"})
+	assertEq(res, expected, "get x")
+	c.mustExecCommand("commit", nil)
+}
+
+func TestWAL_truncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	firstCommit := writeTwoCommits(dir)
+
+	info, err := os.Stat(path)
+	assertEq(err, nil, "stat")
+
+	// Tear the last record, which is the second commit.
+	assertEq(os.Truncate(path, info.Size()-3), nil, "truncate")
+	database := mustOpenDatabase(dir)
+	assertEq(database.transactionState(2), AbortedTransaction, "second transaction")
+
+	// The torn record is cut off, so what is logged next can be
+	// recovered.
+	c := database.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "get x")
+	c.mustExecCommand("set", []string{"x", "3"})
+	c.mustExecCommand("commit", nil)
+	assertEq(database.close(), nil, "close")
+	assertRecoveredX(dir, "3")
+
+	// Cut the log right after the first commit, too.
+	assertEq(os.Truncate(path, firstCommit), nil, "truncate")
+	assertRecoveredX(dir, "1")
+}
+
+func TestWAL_corruptTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	firstCommit := writeTwoCommits(dir)
+
+	// Flip a byte in the second transaction's set record, which
+	// comes after its begin record.
+	data, err := os.ReadFile(path)
+	assertEq(err, nil, "read")
+	offset := firstCommit + int64(len(walRecord{op: walBegin, txId: 2}.encode())) + walHeaderSize
+	data[offset] ^= 0xff
+	assertEq(os.WriteFile(path, data, 0o644), nil, "write")
+
+	// Everything after the corruption is dropped, including the
+	// second commit record.
+	database := mustOpenDatabase(dir)
+	assertEq(database.transactionState(2), AbortedTransaction, "second transaction")
+	assertEq(database.close(), nil, "close")
+
+	assertRecoveredX(dir, "1")
+}
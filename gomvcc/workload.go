@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A mix of transactions in the style of YCSB, run by several clients
+// against a Database.
+type workload struct {
+	name string
+	keys int
+	// Operations per transaction, and the fraction of them that are
+	// reads. The rest are writes.
+	ops             int
+	readFraction    float64
+	clients         int
+	keyDistribution func(r *rand.Rand, keys int) func() int
+	// Writes are read-modify-writes rather than blind sets.
+	increments bool
+}
+
+// Keys are picked with a Zipfian distribution, like in YCSB, so a few
+// are much more popular than the rest.
+func zipfianKeys(r *rand.Rand, keys int) func() int {
+	z := rand.NewZipf(r, 1.1, 1, uint64(keys-1))
+	return func() int { return int(z.Uint64()) }
+}
+
+// Nine in ten operations go to one of four keys.
+func hotKeys(r *rand.Rand, keys int) func() int {
+	return func() int {
+		if r.Float64() < 0.9 {
+			return r.Intn(4)
+		}
+		return r.Intn(keys)
+	}
+}
+
+var workloads = []workload{
+	{name: "read-heavy", keys: 1000, ops: 4, readFraction: 0.95, clients: 8, keyDistribution: zipfianKeys},
+	{name: "write-heavy", keys: 1000, ops: 4, readFraction: 0.5, clients: 8, keyDistribution: zipfianKeys},
+	{name: "hot-key", keys: 1000, ops: 4, readFraction: 0.5, clients: 8, keyDistribution: hotKeys, increments: true},
+}
+
+func findWorkload(name string) (workload, error) {
+	for _, w := range workloads {
+		if w.name == name {
+			return w, nil
+		}
+	}
+	return workload{}, fmt.Errorf("unknown workload %q", name)
+}
+
+// What running a workload did.
+type workloadResult struct {
+	workload  string
+	isolation IsolationLevel
+	// Transactions that committed and aborted, the aborted ones by
+	// reason.
+	committed uint64
+	aborted   map[string]uint64
+	elapsed   time.Duration
+	// Versions kept at the end across every key, and in the longest
+	// chain, with nothing vacuumed.
+	versions     int
+	longestChain int
+}
+
+func (r workloadResult) throughput() float64 {
+	return float64(r.committed) / r.elapsed.Seconds()
+}
+
+// Runs transactions transactions of the workload against d, after
+// loading every key. The clients take turns in an order picked with
+// seed, from a single goroutine, so the same seed always makes the same
+// transactions commit and abort, whatever the machine. Under two-phase
+// locking, d must not wait for locks.
+func (w workload) run(d *Database, seed int64, transactions int) workloadResult {
+	key := func(i int) string { return fmt.Sprintf("user%04d", i) }
+
+	load := d.newConnection()
+	load.mustExecCommand("begin", nil)
+	for i := 0; i < w.keys; i++ {
+		load.mustExecCommand("set", []string{key(i), "0"})
+	}
+	load.mustExecCommand("commit", nil)
+	before := d.stats()
+
+	r := rand.New(rand.NewSource(seed))
+	nextKey := w.keyDistribution(r, w.keys)
+	clients := make([]*Connection, w.clients)
+	remaining := make([]int, w.clients)
+	for i := range clients {
+		clients[i] = d.newConnection()
+	}
+
+	start := time.Now()
+	for step, started := 0, 0; ; step++ {
+		i := r.Intn(len(clients))
+		c := clients[i]
+		if c.tx == nil {
+			if started == transactions {
+				break
+			}
+			c.mustExecCommand("begin", nil)
+			remaining[i] = w.ops
+			started++
+			continue
+		}
+		if remaining[i] == 0 {
+			c.execCommand("commit", nil)
+			continue
+		}
+
+		// Reads and writes fail only when the transaction is
+		// aborted, which the next turn of the client notices.
+		remaining[i]--
+		k := key(nextKey())
+		switch {
+		case r.Float64() < w.readFraction:
+			c.execCommand("get", []string{k})
+		case w.increments:
+			c.execCommand("incr", []string{k, "1"})
+		default:
+			c.execCommand("set", []string{k, strconv.Itoa(step)})
+		}
+	}
+	// Commit whatever is still open.
+	for _, c := range clients {
+		if c.tx != nil {
+			c.execCommand("commit", nil)
+		}
+	}
+
+	after := d.stats()
+	result := workloadResult{
+		workload:  w.name,
+		isolation: d.defaultIsolation,
+		committed: after.committed - before.committed,
+		aborted:   map[string]uint64{},
+		elapsed:   time.Since(start),
+	}
+	for _, reason := range abortReasons {
+		result.aborted[reason] = after.aborted[reason] - before.aborted[reason]
+	}
+	for _, c := range after.chains {
+		result.versions += c.versions
+		result.longestChain = max(result.longestChain, c.versions)
+	}
+	return result
+}
+
+// Runs each workload at each isolation level, on a new database each
+// time, and writes a table of the results to out.
+func runWorkloads(out io.Writer, names []string, seed int64, transactions int) error {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	header := []string{"workload", "isolation", "committed", "aborted", "tx/s"}
+	for _, reason := range abortReasons {
+		header = append(header, "aborted."+strings.ReplaceAll(reason, " ", "-"))
+	}
+	header = append(header, "versions", "versions/key", "longest-chain")
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+
+	for _, name := range names {
+		w, err := findWorkload(name)
+		if err != nil {
+			return err
+		}
+		for level := range isolationLevelNames {
+			d := newDatabase()
+			d.defaultIsolation = IsolationLevel(level)
+			res := w.run(&d, seed, transactions)
+
+			var aborted uint64
+			var reasons []string
+			for _, reason := range abortReasons {
+				aborted += res.aborted[reason]
+				reasons = append(reasons, strconv.FormatUint(res.aborted[reason], 10))
+			}
+			row := []string{
+				res.workload,
+				res.isolation.String(),
+				strconv.FormatUint(res.committed, 10),
+				strconv.FormatUint(aborted, 10),
+				fmt.Sprintf("%.0f", res.throughput()),
+			}
+			row = append(row, reasons...)
+			row = append(row,
+				strconv.Itoa(res.versions),
+				fmt.Sprintf("%.2f", float64(res.versions)/float64(w.keys)),
+				strconv.Itoa(res.longestChain))
+			fmt.Fprintln(tw, strings.Join(row, "\t")+"\t")
+		}
+	}
+	return tw.Flush()
+}
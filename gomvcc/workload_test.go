@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWorkload_deterministic(t *testing.T) {
+	for _, w := range workloads {
+		var results []workloadResult
+		for i := 0; i < 2; i++ {
+			database := newDatabase()
+			database.defaultIsolation = SerializableIsolation
+			results = append(results, w.run(&database, 42, 300))
+		}
+
+		first, second := results[0], results[1]
+		assertEq(first.committed, second.committed, w.name+" committed")
+		for _, reason := range abortReasons {
+			assertEq(first.aborted[reason], second.aborted[reason], w.name+" aborted "+reason)
+		}
+		assertEq(first.versions, second.versions, w.name+" versions")
+		assertEq(first.longestChain, second.longestChain, w.name+" longest chain")
+
+		var aborted uint64
+		for _, n := range first.aborted {
+			aborted += n
+		}
+		assertEq(first.committed+aborted, uint64(300), w.name+" transactions")
+	}
+}
+
+func TestWorkload_table(t *testing.T) {
+	var b strings.Builder
+	assertEq(runWorkloads(&b, []string{"hot-key"}, 1, 100), nil, "run workloads")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assertEq(len(lines), 1+len(isolationLevelNames), "lines")
+	assert(strings.Contains(lines[0], "aborted.write-write-conflict"), lines[0])
+	assert(strings.HasPrefix(strings.Join(strings.Fields(lines[len(lines)-1]), " "), "hot-key serializable "), lines[len(lines)-1])
+
+	err := runWorkloads(&b, []string{"nope"}, 1, 100)
+	assertEq(err.Error(), `unknown workload "nope"`, "unknown workload")
+}
+
+func BenchmarkWorkloads(b *testing.B) {
+	for _, w := range workloads {
+		for _, level := range allIsolationLevels {
+			b.Run(w.name+"/"+level.String(), func(b *testing.B) {
+				database := newDatabase()
+				database.defaultIsolation = level
+				res := w.run(&database, 1, b.N)
+
+				var aborted uint64
+				for _, n := range res.aborted {
+					aborted += n
+				}
+				b.ReportMetric(float64(aborted)/float64(b.N), "aborts/op")
+				b.ReportMetric(float64(res.longestChain), "longest-chain")
+			})
+		}
+	}
+}